@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth wraps next with HTTP basic auth. Requests pass through
+// unchecked when auth is nil.
+func basicAuth(auth *BasicAuthConfig, next http.Handler) http.Handler {
+	if auth == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		// Compare the password even when the username is wrong so both
+		// cases take the same time
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+		passOK := bcrypt.CompareHashAndPassword([]byte(auth.Password), []byte(password)) == nil
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="twse_exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadBaselines reads the baseline prices of baselineFile by symbol,
+// from symbol,price rows for a .csv extension, with an optional
+// symbol,price header, and from a YAML map of symbol to price otherwise
+func loadBaselines(path string) (map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open baselineFile: %v", err)
+	}
+	defer file.Close()
+
+	raw := make(map[string]float64)
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		raw, err = readBaselinesCSV(file)
+	} else {
+		err = yaml.NewDecoder(file).Decode(&raw)
+	}
+	// An empty file has no baselines
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode baselineFile: %v", err)
+	}
+
+	baselines := make(map[string]float64, len(raw))
+	for symbol, price := range raw {
+		if !symbolPattern.MatchString(symbol) {
+			return nil, fmt.Errorf("baselineFile symbol %q is not in prefix_code.market form, e.g. tse_2330.tw", symbol)
+		}
+		baselines[normalizeSymbol(symbol)] = price
+	}
+	return baselines, nil
+}
+
+// readBaselinesCSV reads symbol,price rows
+func readBaselinesCSV(r io.Reader) (map[string]float64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	baselines := make(map[string]float64)
+	for i := 0; ; i++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return baselines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 && strings.EqualFold(record[0], "symbol") {
+			continue
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad price %q of %s", record[1], record[0])
+		}
+		baselines[strings.TrimSpace(record[0])] = price
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elleryq/twse_exporter/twse"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+const defaultCacheTTL = 5 * time.Second
+
+// cacheTTL is how long fetched stock info is served from cache
+var cacheTTL = defaultCacheTTL
+
+// maxStaleness is how long the cache is served after the fetches
+// started failing, 0 to serve nothing. Guarded by cacheMutex.
+var maxStaleness time.Duration
+
+// backgroundRefresh is set when runRefresher keeps the cache fresh, so
+// scrapes only read the cache
+var backgroundRefresh bool
+
+var (
+	// exChList, groups and stockFetcher are swapped on reload, guarded
+	// by cacheMutex
+	exChList     []string
+	groups       map[string][]string
+	stockFetcher = twse.NewFetcher(&http.Client{Timeout: twse.DefaultTimeout}, twse.DefaultBaseURL)
+
+	// cache holds the stocks by twse.Symbol, in cacheOrder. Each stock
+	// keeps its own fetch time, so stocks missing from a partial fetch
+	// keep serving their last-known value.
+	cache          = make(map[string]twse.CachedStock)
+	cacheOrder     []string
+	cacheErr       error
+	cacheTimestamp time.Time
+	// cacheFailed is set when the last fetch failed for every symbol
+	cacheFailed bool
+	// cacheJitter is added to cacheTTL, redrawn on every fetch
+	cacheJitter time.Duration
+	// cacheGeneration is bumped by resetCache, so a fetch started
+	// before a reload is not merged into the new cache
+	cacheGeneration int
+	// cacheRefreshing is set while refreshCache fetches
+	cacheRefreshing bool
+	// cacheMutex is only held to read or swap the cache, never across a
+	// fetch, so scrapes read the cache while a refresh is in progress
+	cacheMutex sync.RWMutex
+
+	// limiter caps the requests of stockFetcher, nil for no limit. It is
+	// kept across reloads of the same rateLimit, guarded by cacheMutex.
+	limiter *rate.Limiter
+
+	// fetchGroup coalesces the fetches of concurrent cache misses
+	fetchGroup singleflight.Group
+
+	// refreshNow wakes runRefresher before its next tick, e.g. after a
+	// reload emptied the cache
+	refreshNow = make(chan struct{}, 1)
+)
+
+// getCachedStockInfo returns the cached stocks, refreshing them when
+// expired, together with the time of the last successful fetch.
+// Concurrent misses share a single fetch. Misses during a fetch do not
+// wait for it while the cache is within maxStaleness, or after a failed
+// fetch, and are answered as a failed fetch would be. It is the
+// twse.Source of stockMetrics.
+func getCachedStockInfo(ctx context.Context) ([]twse.CachedStock, time.Time, error) {
+	for {
+		cacheMutex.RLock()
+		if backgroundRefresh {
+			cacheHits.Inc()
+			defer cacheMutex.RUnlock()
+			if cacheTimestamp.IsZero() && cacheErr == nil {
+				return nil, cacheTimestamp, errors.New("no stock info fetched yet")
+			}
+			if cacheFailed {
+				return staleStocks(cacheErr)
+			}
+			return cachedStocks(), cacheTimestamp, cacheErr
+		}
+		if time.Since(cacheTimestamp) < cacheTTL+cacheJitter {
+			slog.Debug("Serving stock info from cache", "age_ms", time.Since(cacheTimestamp).Milliseconds())
+			cacheHits.Inc()
+			defer cacheMutex.RUnlock()
+			return cachedStocks(), cacheTimestamp, cacheErr
+		}
+
+		// The quote feed is static outside trading hours, keep the last values
+		if marketHoursOnly && !cacheTimestamp.IsZero() && !calendar.isOpen(time.Now()) {
+			cacheHits.Inc()
+			defer cacheMutex.RUnlock()
+			return cachedStocks(), cacheTimestamp, cacheErr
+		}
+
+		// Another scrape is fetching already, serve what there is as long
+		// as a failed fetch would still serve it
+		if cacheRefreshing && cacheFailed {
+			cacheHits.Inc()
+			defer cacheMutex.RUnlock()
+			return staleStocks(cacheErr)
+		}
+		if cacheRefreshing && !cacheTimestamp.IsZero() && time.Since(cacheTimestamp) < cacheTTL+cacheJitter+maxStaleness {
+			slog.Debug("Serving stock info from cache during refresh", "age_ms", time.Since(cacheTimestamp).Milliseconds())
+			cacheHits.Inc()
+			defer cacheMutex.RUnlock()
+			return cachedStocks(), cacheTimestamp, cacheErr
+		}
+		cacheMisses.Inc()
+		cacheMutex.RUnlock()
+
+		var result singleflight.Result
+		select {
+		case result = <-fetchGroup.DoChan("stocks", func() (interface{}, error) {
+			return refreshCache(ctx)
+		}):
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
+		}
+		// The scrape leading the fetch went away, fetch again with ours
+		if ctx.Err() == nil && (errors.Is(result.Err, context.Canceled) || errors.Is(result.Err, context.DeadlineExceeded)) {
+			continue
+		}
+
+		cacheMutex.RLock()
+		defer cacheMutex.RUnlock()
+		if stored, _ := result.Val.(bool); !stored {
+			return staleStocks(result.Err)
+		}
+		return cachedStocks(), cacheTimestamp, result.Err
+	}
+}
+
+// refreshCache fetches the stock info and merges it into the cache,
+// reporting whether anything was stored. A fetch aborted by ctx, a total
+// failure or a reload during the fetch leaves the cache untouched.
+func refreshCache(ctx context.Context) (bool, error) {
+	cacheMutex.Lock()
+	f, list, generation := stockFetcher, exChList, cacheGeneration
+	cacheRefreshing = true
+	cacheMutex.Unlock()
+	defer func() {
+		cacheMutex.Lock()
+		cacheRefreshing = false
+		cacheMutex.Unlock()
+	}()
+
+	// The error of a partial fetch is cached, so cache hits keep
+	// reporting the degraded state until the next fetch.
+	start := time.Now()
+	stockInfos, err := f.FetchStockInfo(ctx, list)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	scrapeDuration.Observe(time.Since(start).Seconds())
+	limited := errors.Is(err, twse.ErrRateLimited)
+	if limited {
+		rateLimited.Inc()
+	} else if err != nil {
+		fetchErrors.WithLabelValues(twse.ErrorReason(err)).Inc()
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if generation != cacheGeneration {
+		return false, err
+	}
+	if len(stockInfos) == 0 && err != nil {
+		// Serve the cache as is when over the rate limit
+		if limited {
+			slog.Debug("Rate limited, serving stock info from cache")
+			if cacheTimestamp.IsZero() {
+				return false, errors.New("rate limited before the first fetch")
+			}
+			return true, cacheErr
+		}
+		// Kept for the scrapes during the next fetch
+		cacheFailed = true
+		cacheErr = err
+		return false, err
+	}
+	cacheFailed = false
+	cacheStale.Set(0)
+	now := time.Now()
+	for _, info := range stockInfos {
+		symbol := twse.Symbol(info)
+		if _, ok := cache[symbol]; !ok {
+			cacheOrder = append(cacheOrder, symbol)
+		}
+		cache[symbol] = twse.CachedStock{Info: info, FetchedAt: now}
+	}
+	cacheErr = err
+	cacheTimestamp = now
+	// Spread the expiry of replicas started together over 10% of the TTL
+	cacheJitter = time.Duration(rand.Int63n(int64(cacheTTL)/10 + 1))
+
+	return true, err
+}
+
+// warmUp fetches once so the first scrape is served from cache. A
+// failure is only logged, the next scrape or refresh tries again.
+func warmUp(ctx context.Context) {
+	start := time.Now()
+	stored, err := refreshCache(ctx)
+	if !stored {
+		slog.Warn("Warm-up fetch failed, starting anyway", "err", err)
+		// Background scrapes have nothing else to report it by
+		cacheMutex.Lock()
+		cacheErr = err
+		cacheMutex.Unlock()
+		return
+	}
+	if err != nil {
+		slog.Warn("Warm-up fetch partially failed", "err", err)
+	}
+	cacheMutex.RLock()
+	stocks := len(cache)
+	cacheMutex.RUnlock()
+	slog.Info("Warmed up cache", "stocks", stocks, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// runRefresher refreshes the cache every interval until ctx is done,
+// instead of fetching on scrape
+func runRefresher(ctx context.Context, interval time.Duration) {
+	cacheMutex.Lock()
+	backgroundRefresh = true
+	cacheMutex.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		cacheMutex.RLock()
+		skip := marketHoursOnly && !cacheTimestamp.IsZero() && !calendar.isOpen(time.Now())
+		// Right after warmUp the cache is fresh already
+		skip = skip || (first && time.Since(cacheTimestamp) < interval)
+		cacheMutex.RUnlock()
+
+		if !skip {
+			stored, err := refreshCache(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Error("Failed to refresh stock info", "err", err)
+			}
+			// Scrapes have nothing else to report a total failure by
+			if !stored && err != nil {
+				cacheMutex.Lock()
+				cacheErr = err
+				cacheMutex.Unlock()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-refreshNow:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// staleStocks returns the cache after a failed fetch along with err, as
+// long as it is within maxStaleness, cacheMutex must be held for reading
+func staleStocks(err error) ([]twse.CachedStock, time.Time, error) {
+	if cacheTimestamp.IsZero() || maxStaleness <= 0 || time.Since(cacheTimestamp) > maxStaleness {
+		cacheStale.Set(0)
+		return nil, cacheTimestamp, err
+	}
+	slog.Debug("Serving stale stock info", "age_ms", time.Since(cacheTimestamp).Milliseconds())
+	cacheStale.Set(1)
+	return cachedStocks(), cacheTimestamp, err
+}
+
+// groupSymbols returns the symbols of the named group in effect
+func groupSymbols(name string) ([]string, bool) {
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+
+	symbols, ok := groups[name]
+	return symbols, ok
+}
+
+// cachedStocks returns the cached stocks in order, cacheMutex must be
+// held for reading
+func cachedStocks() []twse.CachedStock {
+	stocks := make([]twse.CachedStock, 0, len(cacheOrder))
+	for _, symbol := range cacheOrder {
+		stocks = append(stocks, cache[symbol])
+	}
+	return stocks
+}
+
+// resetCache drops every cached stock, cacheMutex must be held
+func resetCache() {
+	cache = make(map[string]twse.CachedStock)
+	cacheOrder = nil
+	cacheErr = nil
+	cacheTimestamp = time.Time{}
+	cacheFailed = false
+	cacheStale.Set(0)
+	cacheGeneration++
+}
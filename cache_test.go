@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elleryq/twse_exporter/twse"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// cacheFetched reports whether the cache holds a successful fetch
+func cacheFetched() bool {
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+	return !cacheTimestamp.IsZero()
+}
+
+// startRefresher runs runRefresher until the test is done
+func startRefresher(t *testing.T, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runRefresher(ctx, interval)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		cacheMutex.Lock()
+		backgroundRefresh = false
+		cacheMutex.Unlock()
+	})
+}
+
+func TestRunRefresherAfterReload(t *testing.T) {
+	server := useUpstream(t, serveFile(t, testPayload), nil)
+	startRefresher(t, time.Hour)
+	waitFor(t, "the first refresh", cacheFetched)
+
+	applyConfig(&Config{ExChList: testSymbols, BaseURL: server.URL, MaxRetries: intPtr(0)})
+	// Well before the next tick in an hour
+	waitFor(t, "a refresh after the reload", cacheFetched)
+
+	stocks, _, err := getCachedStockInfo(context.Background())
+	if err != nil || len(stocks) != len(testSymbols) {
+		t.Errorf("getCachedStockInfo() = %d stocks, %v, want %d stocks", len(stocks), err, len(testSymbols))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var requests atomic.Int32
+	payload := serveFile(t, testPayload)
+	// Every scrape misses the cache, one request per minute
+	server := useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		payload(w, r)
+	}), &Config{RateLimit: 1, CacheTTL: Duration(time.Nanosecond)})
+	limited := exporterMetric(t, "twse_rate_limited_total")
+
+	for i := 0; i < 5; i++ {
+		stocks, _, err := getCachedStockInfo(context.Background())
+		if err != nil || len(stocks) != len(testSymbols) {
+			t.Errorf("scrape %d: %d stocks, %v, want the cache", i, len(stocks), err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+	if got := exporterMetric(t, "twse_rate_limited_total") - limited; got != 4 {
+		t.Errorf("rate_limited_total increased by %v, want 4", got)
+	}
+
+	// A reload keeps the budget of the same rateLimit
+	l := limiter
+	applyConfig(&Config{ExChList: testSymbols, BaseURL: server.URL, MaxRetries: intPtr(0), RateLimit: 1})
+	if limiter != l {
+		t.Error("reload replaced the limiter of an unchanged rateLimit")
+	}
+	applyConfig(&Config{ExChList: testSymbols, BaseURL: server.URL, MaxRetries: intPtr(0), RateLimit: 2})
+	if limiter == l {
+		t.Error("reload kept the limiter of a changed rateLimit")
+	}
+}
+
+func TestGetCachedStockInfoCancel(t *testing.T) {
+	var slow atomic.Bool
+	aborted := make(chan struct{}, 1)
+	payload := serveFile(t, testPayload)
+	useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			<-r.Context().Done()
+			aborted <- struct{}{}
+			return
+		}
+		payload(w, r)
+	}), &Config{CacheTTL: Duration(time.Nanosecond)})
+	if _, _, err := getCachedStockInfo(context.Background()); err != nil {
+		t.Fatalf("getCachedStockInfo() error = %v", err)
+	}
+	cacheMutex.RLock()
+	fetchedAt := cacheTimestamp
+	cacheMutex.RUnlock()
+
+	slow.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := getCachedStockInfo(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getCachedStockInfo() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("getCachedStockInfo() took %v, want it to return on cancel", elapsed)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(3 * time.Second):
+		t.Error("the request to TWSE was not aborted")
+	}
+
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+	if !cacheTimestamp.Equal(fetchedAt) || cacheErr != nil || len(cache) != len(testSymbols) {
+		t.Errorf("cache changed by the cancelled fetch: %v, %v, %d stocks", cacheTimestamp, cacheErr, len(cache))
+	}
+}
+
+func TestGetCachedStockInfoSingleFetch(t *testing.T) {
+	const scrapes = 10
+	var requests atomic.Int32
+	release := make(chan struct{})
+	payload := serveFile(t, testPayload)
+	useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		payload(w, r)
+	}), nil)
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	// Runs before the server is closed, should the test fail early
+	t.Cleanup(unblock)
+	misses := exporterMetric(t, "twse_cache_misses_total")
+
+	var wg sync.WaitGroup
+	for i := 0; i < scrapes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stocks, _, err := getCachedStockInfo(context.Background())
+			if err != nil || len(stocks) != len(testSymbols) {
+				t.Errorf("getCachedStockInfo() = %d stocks, %v, want %d stocks", len(stocks), err, len(testSymbols))
+			}
+		}()
+	}
+	// Hold the fetch until every scrape has missed the empty cache
+	waitFor(t, "every scrape to miss", func() bool {
+		return exporterMetric(t, "twse_cache_misses_total")-misses == scrapes
+	})
+	unblock()
+	wg.Wait()
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests for %d concurrent misses, want 1", n, scrapes)
+	}
+}
+
+func TestRefreshCacheErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		// config is applied with the upstream, nil for the defaults
+		config *Config
+		reason string
+		// counter also increases by one, empty for none
+		counter string
+	}{
+		{
+			name: "503",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			},
+			reason: "http_status",
+		},
+		{
+			name: "empty msgArray",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"msgArray":[],"rtcode":"0000","rtmessage":"OK"}`))
+			},
+			reason:  "empty_response",
+			counter: "twse_empty_responses_total",
+		},
+		{
+			name: "HTML page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html><title>系統維護</title></html>"))
+			},
+			reason:  "decode",
+			counter: "twse_decode_errors_total",
+		},
+		{
+			name:    "rtcode",
+			handler: serveFile(t, "twse/testdata/getStockInfo_error.json"),
+			reason:  "upstream_error",
+		},
+		{
+			name:    "too large",
+			handler: serveFile(t, testPayload),
+			config:  &Config{MaxResponseBytes: 1024},
+			reason:  "too_large",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, tt.handler, tt.config)
+			errs := exporterMetric(t, "twse_fetch_errors_total", "reason", tt.reason)
+			var count float64
+			if tt.counter != "" {
+				count = exporterMetric(t, tt.counter)
+			}
+
+			// The scrape succeeds with twse_up 0
+			rec := scrape(metricsHandler(stockMetrics, promhttp.HandlerOpts{}), "/metrics")
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "\ntwse_up 0\n") {
+				t.Errorf("status = %d, want 200 with twse_up 0:\n%s", rec.Code, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), "twse_stock_price{") {
+				t.Error("got stock_price without stock info")
+			}
+			if got := exporterMetric(t, "twse_fetch_errors_total", "reason", tt.reason) - errs; got != 1 {
+				t.Errorf("fetch_errors_total{reason=%q} increased by %v, want 1", tt.reason, got)
+			}
+			if tt.counter != "" {
+				if got := exporterMetric(t, tt.counter) - count; got != 1 {
+					t.Errorf("%s increased by %v, want 1", tt.counter, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGetCachedStockInfoStale(t *testing.T) {
+	var down atomic.Bool
+	payload := serveFile(t, testPayload)
+	useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		payload(w, r)
+	}), &Config{CacheTTL: Duration(time.Nanosecond), MaxStaleness: Duration(time.Hour)})
+
+	// Fresh
+	stocks, fetchedAt, err := getCachedStockInfo(context.Background())
+	if err != nil || len(stocks) != len(testSymbols) {
+		t.Fatalf("fresh: %d stocks, %v, want %d stocks", len(stocks), err, len(testSymbols))
+	}
+	if got := exporterMetric(t, "twse_cache_stale"); got != 0 {
+		t.Errorf("fresh: cache_stale = %v, want 0", got)
+	}
+
+	// Stale, within maxStaleness
+	down.Store(true)
+	stocks, staleAt, err := getCachedStockInfo(context.Background())
+	if err == nil || len(stocks) != len(testSymbols) {
+		t.Errorf("stale: %d stocks, %v, want %d stocks and the error", len(stocks), err, len(testSymbols))
+	}
+	if !staleAt.Equal(fetchedAt) {
+		t.Errorf("stale: last update %v, want the fetch at %v", staleAt, fetchedAt)
+	}
+	if got := exporterMetric(t, "twse_cache_stale"); got != 1 {
+		t.Errorf("stale: cache_stale = %v, want 1", got)
+	}
+
+	// Too stale, past maxStaleness
+	cacheMutex.Lock()
+	cacheTimestamp = cacheTimestamp.Add(-2 * time.Hour)
+	cacheMutex.Unlock()
+	stocks, _, err = getCachedStockInfo(context.Background())
+	if err == nil || len(stocks) != 0 {
+		t.Errorf("too stale: %d stocks, %v, want none and the error", len(stocks), err)
+	}
+	if got := exporterMetric(t, "twse_cache_stale"); got != 0 {
+		t.Errorf("too stale: cache_stale = %v, want 0", got)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	var requests atomic.Int32
+	payload := serveFile(t, testPayload)
+	useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		payload(w, r)
+	}), nil)
+
+	// The first scrape is served from the warmed up cache
+	warmUp(context.Background())
+	stocks, _, err := getCachedStockInfo(context.Background())
+	if err != nil || len(stocks) != len(testSymbols) {
+		t.Errorf("getCachedStockInfo() = %d stocks, %v, want %d stocks", len(stocks), err, len(testSymbols))
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1 by the warm-up", n)
+	}
+}
+
+func TestWarmUpFailure(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	payload := serveFile(t, testPayload)
+	useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		payload(w, r)
+	}), nil)
+
+	// A failed warm-up is kept for background scrapes to report
+	warmUp(context.Background())
+	cacheMutex.RLock()
+	err := cacheErr
+	cacheMutex.RUnlock()
+	if err == nil || cacheFetched() {
+		t.Errorf("cache after a failed warm-up: %v, fetched %v, want the error", err, cacheFetched())
+	}
+
+	// The next scrape tries again
+	down.Store(false)
+	stocks, _, err := getCachedStockInfo(context.Background())
+	if err != nil || len(stocks) != len(testSymbols) {
+		t.Errorf("getCachedStockInfo() = %d stocks, %v, want %d stocks", len(stocks), err, len(testSymbols))
+	}
+}
+
+func TestGetCachedStockInfoDuringRefresh(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxStaleness time.Duration
+		// outage fails the fetch before the slow refresh
+		outage     bool
+		wantStocks int
+		wantErr    bool
+	}{
+		{name: "within maxStaleness", maxStaleness: time.Hour, wantStocks: len(testSymbols)},
+		{name: "outage", outage: true, wantErr: true},
+		{name: "outage within maxStaleness", maxStaleness: time.Hour, outage: true, wantStocks: len(testSymbols), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var down, slow atomic.Bool
+			release := make(chan struct{})
+			payload := serveFile(t, testPayload)
+			useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if slow.Load() {
+					<-release
+				}
+				if down.Load() {
+					http.Error(w, "maintenance", http.StatusServiceUnavailable)
+					return
+				}
+				payload(w, r)
+			}), &Config{CacheTTL: Duration(time.Nanosecond), MaxStaleness: Duration(tt.maxStaleness)})
+			var once sync.Once
+			unblock := func() { once.Do(func() { close(release) }) }
+			t.Cleanup(unblock)
+			if _, _, err := getCachedStockInfo(context.Background()); err != nil {
+				t.Fatalf("getCachedStockInfo() error = %v", err)
+			}
+			if tt.outage {
+				down.Store(true)
+				getCachedStockInfo(context.Background())
+			}
+
+			// A scrape stuck in a slow refresh
+			slow.Store(true)
+			refreshed := make(chan struct{})
+			go func() {
+				defer close(refreshed)
+				getCachedStockInfo(context.Background())
+			}()
+			waitFor(t, "the refresh", func() bool {
+				cacheMutex.RLock()
+				defer cacheMutex.RUnlock()
+				return cacheRefreshing
+			})
+
+			// Concurrent scrapes are answered meanwhile, like after a
+			// failed fetch
+			var wg sync.WaitGroup
+			start := time.Now()
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					stocks, _, err := getCachedStockInfo(context.Background())
+					if len(stocks) != tt.wantStocks || (err != nil) != tt.wantErr {
+						t.Errorf("getCachedStockInfo() = %d stocks, %v, want %d stocks, error %v", len(stocks), err, tt.wantStocks, tt.wantErr)
+					}
+				}()
+			}
+			wg.Wait()
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("reads took %v during the refresh, want them not to wait for it", elapsed)
+			}
+
+			unblock()
+			<-refreshed
+		})
+	}
+}
+
+func BenchmarkGetCachedStockInfo(b *testing.B) {
+	cacheMutex.Lock()
+	resetCache()
+	cache["tse_2330.tw"] = twse.CachedStock{Info: twse.StockInfo{Ex: "tse", Ch: "2330.tw"}, FetchedAt: time.Now()}
+	cacheOrder = []string{"tse_2330.tw"}
+	cacheTimestamp = time.Now()
+	// Every read finds a refresh in progress
+	cacheRefreshing = true
+	ttl, staleness := cacheTTL, maxStaleness
+	cacheTTL, cacheJitter, maxStaleness = 0, 0, time.Hour
+	cacheMutex.Unlock()
+	defer func() {
+		cacheMutex.Lock()
+		cacheRefreshing = false
+		cacheTTL, maxStaleness = ttl, staleness
+		resetCache()
+		cacheMutex.Unlock()
+	}()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			getCachedStockInfo(context.Background())
+		}
+	})
+}
+
+func TestRateLimitChunks(t *testing.T) {
+	for _, primeSession := range []bool{false, true} {
+		t.Run(fmt.Sprintf("primeSession %v", primeSession), func(t *testing.T) {
+			var requests atomic.Int32
+			payload := serveFile(t, testPayload)
+			// Three chunks in one fetch, well under 30 requests per minute
+			useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				payload(w, r)
+			}), &Config{RateLimit: 30, ChunkSize: 1, PrimeSession: primeSession})
+			limited := exporterMetric(t, "twse_rate_limited_total")
+
+			stocks, _, err := getCachedStockInfo(context.Background())
+			if err != nil || len(stocks) != len(testSymbols) {
+				t.Errorf("getCachedStockInfo() = %d stocks, %v, want %d stocks", len(stocks), err, len(testSymbols))
+			}
+			if got := exporterMetric(t, "twse_rate_limited_total") - limited; got != 0 {
+				t.Errorf("rate_limited_total increased by %v, want 0", got)
+			}
+			// The index page of every chunk primes the session too
+			want := int32(len(testSymbols))
+			if primeSession {
+				want *= 2
+			}
+			if n := requests.Load(); n != want {
+				t.Errorf("sent %d requests, want %d", n, want)
+			}
+		})
+	}
+}
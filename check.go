@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// runCheck fetches once through the /metrics handler, writes the metrics
+// to w and reports whether the fetch succeeded, for -check
+func runCheck(w io.Writer) error {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	metricsHandler(stockMetrics, promhttp.HandlerOpts{}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("failed to render metrics: HTTP %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := io.Copy(w, rec.Body); err != nil {
+		return err
+	}
+
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+	if cacheTimestamp.IsZero() {
+		return errors.New("no stock info fetched from TWSE")
+	}
+	return cacheErr
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/elleryq/twse_exporter/twse"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	// Symbols passed to ex_ch, e.g. tse_2330.tw for listed stocks and
+	// otc_6488.tw for OTC stocks. Both tse and otc prefixes are handled;
+	// the ex field returned by TWSE becomes the exchange label.
+	ExChList []string `yaml:"exChList" json:"exChList"`
+	// Named symbol lists, each served on /metrics/<group>. Their symbols
+	// are fetched along with exChList, which /metrics serves with them.
+	Groups  map[string][]string `yaml:"groups" json:"groups"`
+	Address string              `yaml:"address" json:"address"`
+	Port    int                 `yaml:"port" json:"port"`
+	// Base URL of the MIS API, default http://mis.twse.com.tw/stock
+	BaseURL string `yaml:"baseURL" json:"baseURL"`
+	// Base URLs of MIS mirrors tried in order, e.g. on an outage of the
+	// main host. Overrides baseURL when set.
+	UpstreamURLs []string `yaml:"upstreamURLs" json:"upstreamURLs"`
+	// Timeout of the request to TWSE, default 10s
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	// Retries of a failed request to TWSE, default 3
+	MaxRetries *int `yaml:"maxRetries" json:"maxRetries"`
+	// User-Agent header sent to TWSE, default twse_exporter/<version>
+	UserAgent string `yaml:"userAgent" json:"userAgent"`
+	// Proxy to TWSE, http(s):// or socks5://, default from the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY env
+	ProxyURL string `yaml:"proxyURL" json:"proxyURL"`
+	// Max idle connections kept to TWSE, default 100
+	MaxIdleConns int `yaml:"maxIdleConns" json:"maxIdleConns"`
+	// How long an idle connection to TWSE is kept, default 30s, below
+	// the idle timeout of MIS so a reused connection is not reset
+	IdleConnTimeout Duration `yaml:"idleConnTimeout" json:"idleConnTimeout"`
+	// Open a new connection for every request to TWSE
+	DisableKeepAlives bool `yaml:"disableKeepAlives" json:"disableKeepAlives"`
+	// Fetch the MIS index page for a session cookie before querying
+	PrimeSession bool `yaml:"primeSession" json:"primeSession"`
+	// Max symbols per request to TWSE, default 50
+	ChunkSize int `yaml:"chunkSize" json:"chunkSize"`
+	// Max chunks fetched concurrently, default 4
+	MaxConcurrency int `yaml:"maxConcurrency" json:"maxConcurrency"`
+	// Max size of a response from TWSE in bytes, default 4MiB
+	MaxResponseBytes int64 `yaml:"maxResponseBytes" json:"maxResponseBytes"`
+	// Max requests to TWSE per minute, default 0 for no limit. Every
+	// chunk of chunkSize symbols, retry, upstream tried and session
+	// priming counts, a fetch of exChList may send them at once. Over
+	// the limit the cache is served.
+	RateLimit float64 `yaml:"rateLimit" json:"rateLimit"`
+	// How long fetched stock info is cached, default 5s
+	CacheTTL Duration `yaml:"cacheTTL" json:"cacheTTL"`
+	// How long the last fetched stock info is served while fetching from
+	// TWSE fails, default 0 to serve none
+	MaxStaleness Duration `yaml:"maxStaleness" json:"maxStaleness"`
+	// Fetch in the background at this interval instead of on scrape,
+	// default 0 for on scrape. Only takes effect on restart.
+	RefreshInterval Duration `yaml:"refreshInterval" json:"refreshInterval"`
+	// Serve cached values without fetching outside trading hours
+	MarketHoursOnly bool `yaml:"marketHoursOnly" json:"marketHoursOnly"`
+	// Non-trading weekdays as YYYY-MM-DD, used with marketHoursOnly
+	Holidays []string `yaml:"holidays" json:"holidays"`
+	// How close the price must be to a limit for twse_stock_at_limit,
+	// default 0.005
+	LimitEpsilon float64 `yaml:"limitEpsilon" json:"limitEpsilon"`
+	// Prefix of every exported metric, default twse. Only takes effect
+	// on restart.
+	MetricPrefix string `yaml:"metricPrefix" json:"metricPrefix"`
+	// Go text/template for the help of the per-stock series, executed
+	// with .Name, e.g. price, and .Help, the default help. Only takes
+	// effect on restart.
+	HelpTemplate string `yaml:"helpTemplate" json:"helpTemplate"`
+	// Alias label of the series of a symbol, e.g. tse_2330.tw: TSMC
+	SymbolAliases map[string]string `yaml:"symbolAliases" json:"symbolAliases"`
+	// Labels added to every exported series, e.g. env: prod. Only takes
+	// effect on restart.
+	StaticLabels map[string]string `yaml:"staticLabels" json:"staticLabels"`
+	// Log level, one of debug, info, warn and error, default info
+	LogLevel string `yaml:"logLevel" json:"logLevel"`
+	// Log format, json or text for local development, default json.
+	// Only takes effect on restart.
+	LogFormat string `yaml:"logFormat" json:"logFormat"`
+	// Quote age after which twse_stock_stale is 1, default 5m
+	StaleThreshold Duration `yaml:"staleThreshold" json:"staleThreshold"`
+	// Glob patterns on <ex>_<code>, e.g. tse_23*, selecting the stocks
+	// to export. An empty include exports all, exclude wins over include.
+	Include []string `yaml:"include" json:"include"`
+	Exclude []string `yaml:"exclude" json:"exclude"`
+	// Answer /metrics with 500 when no symbol has a price, instead of 200
+	// with twse_up 0
+	FailOnTotalOutage bool `yaml:"failOnTotalOutage" json:"failOnTotalOutage"`
+	// Per-stock series to emit, named after <prefix>_stock_, e.g. price
+	// or bid_volume, default all
+	Metrics []string `yaml:"metrics" json:"metrics"`
+	// Send the series of fields that are 0, e.g. the volume early in the
+	// session, default true. Fields without a value, e.g. "-", are never
+	// sent.
+	EmitZeroValues *bool `yaml:"emitZeroValues" json:"emitZeroValues"`
+	// Stamp the series of a symbol with its quote time instead of the
+	// scrape time. Prometheus drops samples over about an hour old, e.g.
+	// quotes from the last session outside trading hours.
+	SampleTimestamps bool `yaml:"sampleTimestamps" json:"sampleTimestamps"`
+	// Decimals the price-like series are rounded to, half to even,
+	// default no rounding
+	PriceDecimals *int `yaml:"priceDecimals" json:"priceDecimals"`
+	// CSV of symbol,price rows, or YAML map of symbol to price, with the
+	// baseline price of symbols such as a 20-day average. Reread on
+	// reload.
+	BaselineFile string `yaml:"baselineFile" json:"baselineFile"`
+	// baselines are read from BaselineFile by parseConfig
+	baselines map[string]float64
+	// Raw fields exported as labels of <prefix>_stock_info, one of n, nf,
+	// ex, c and ch, default none for no stock_info
+	InfoLabels []string `yaml:"infoLabels" json:"infoLabels"`
+	// Most stock series a scrape serves, default 0 for no limit. Series
+	// past it are dropped, with <prefix>_series_limit_exceeded 1.
+	MaxSeries int `yaml:"maxSeries" json:"maxSeries"`
+	// Grace period for in-flight requests on shutdown, default 5s
+	ShutdownTimeout Duration `yaml:"shutdownTimeout" json:"shutdownTimeout"`
+	// Serve over HTTPS when both files are set
+	TLS TLSConfig `yaml:"tls" json:"tls"`
+	// Protect /metrics with basic auth when set
+	BasicAuth *BasicAuthConfig `yaml:"basicAuth" json:"basicAuth"`
+}
+
+// Duration is a time.Duration decoded from strings like "15s" in both
+// YAML and JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile" json:"certFile"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile"`
+}
+
+type BasicAuthConfig struct {
+	Username string `yaml:"username" json:"username"`
+	// bcrypt hash of the password
+	Password string `yaml:"password" json:"password"`
+}
+
+// defaultIdleConnTimeout is shorter than the 90s of http.DefaultTransport
+const defaultIdleConnTimeout = 30 * time.Second
+
+// symbolPattern is the prefix_code.market shape of an exChList entry
+var symbolPattern = regexp.MustCompile(`^[A-Za-z]+_[0-9A-Za-z]+\.[A-Za-z]+$`)
+
+// groupNamePattern is a groups name, used as a path segment
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// metricPrefixPattern is a Prometheus metric name without colons, which
+// are reserved for recording rules
+var metricPrefixPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelNamePattern is a Prometheus label name
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are the label names of the exported series, which a
+// static label would clash with
+var reservedLabels = []string{
+	"exchange", "code", "suffix", "name", "market", "currency", "alias", "price_source", "level", "index",
+	"ip", "ts", "n", "nf", "ex", "c", "ch", "reason", "symbol", "upstream", "outcome",
+	"version", "revision", "builddate", "goversion", "le",
+}
+
+// Validate checks the config for mistakes that would serve broken metrics
+func (c *Config) Validate() error {
+	if len(c.ExChList) == 0 && len(c.Groups) == 0 {
+		return errors.New("exChList is empty")
+	}
+	for _, symbol := range c.ExChList {
+		if !symbolPattern.MatchString(symbol) {
+			return fmt.Errorf("exChList entry %q is not in prefix_code.market form, e.g. tse_2330.tw", symbol)
+		}
+	}
+	for name, symbols := range c.Groups {
+		if !groupNamePattern.MatchString(name) {
+			return fmt.Errorf("group name %q must only have letters, digits, _ and -", name)
+		}
+		if len(symbols) == 0 {
+			return fmt.Errorf("group %q is empty", name)
+		}
+		for _, symbol := range symbols {
+			if !symbolPattern.MatchString(symbol) {
+				return fmt.Errorf("group %q entry %q is not in prefix_code.market form, e.g. tse_2330.tw", name, symbol)
+			}
+		}
+	}
+	for _, day := range c.Holidays {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			return fmt.Errorf("holiday %q is not in YYYY-MM-DD form", day)
+		}
+	}
+	for _, u := range c.UpstreamURLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("upstreamURLs entry %q is not an http(s) URL", u)
+		}
+	}
+	if c.ProxyURL != "" {
+		if _, err := parseProxyURL(c.ProxyURL); err != nil {
+			return err
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls needs both certFile and keyFile")
+	}
+	if c.BasicAuth != nil {
+		if c.BasicAuth.Username == "" {
+			return errors.New("basicAuth needs a username")
+		}
+		if _, err := bcrypt.Cost([]byte(c.BasicAuth.Password)); err != nil {
+			return fmt.Errorf("basicAuth password is not a bcrypt hash: %v", err)
+		}
+	}
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad include/exclude pattern %q: %v", pattern, err)
+		}
+	}
+	for _, name := range c.Metrics {
+		if !slices.Contains(twse.StockMetricNames, name) {
+			return fmt.Errorf("unknown metric %q, expected one of %s", name, strings.Join(twse.StockMetricNames, ", "))
+		}
+	}
+	for i, field := range c.InfoLabels {
+		if !slices.Contains(twse.InfoFields, field) {
+			return fmt.Errorf("unknown infoLabels field %q, expected one of %s", field, strings.Join(twse.InfoFields, ", "))
+		}
+		if slices.Contains(c.InfoLabels[:i], field) {
+			return fmt.Errorf("duplicated infoLabels field %q", field)
+		}
+	}
+	if c.PriceDecimals != nil && (*c.PriceDecimals < 0 || *c.PriceDecimals > 10) {
+		return fmt.Errorf("priceDecimals %d out of range 0-10", *c.PriceDecimals)
+	}
+	if c.MaxRetries != nil && *c.MaxRetries < 0 {
+		return fmt.Errorf("maxRetries %d must not be negative", *c.MaxRetries)
+	}
+	if c.MaxSeries < 0 {
+		return fmt.Errorf("maxSeries %d must not be negative", c.MaxSeries)
+	}
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("maxIdleConns %d must not be negative", c.MaxIdleConns)
+	}
+	if c.MaxResponseBytes < 0 {
+		return fmt.Errorf("maxResponseBytes %d must not be negative", c.MaxResponseBytes)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rateLimit %v must not be negative", c.RateLimit)
+	}
+	if c.LimitEpsilon < 0 {
+		return fmt.Errorf("limitEpsilon %v must not be negative", c.LimitEpsilon)
+	}
+	if c.MetricPrefix != "" && !metricPrefixPattern.MatchString(c.MetricPrefix) {
+		return fmt.Errorf("metricPrefix %q is not a valid metric name", c.MetricPrefix)
+	}
+	if _, err := c.helpTemplate(); err != nil {
+		return err
+	}
+	for symbol, alias := range c.SymbolAliases {
+		if !symbolPattern.MatchString(symbol) {
+			return fmt.Errorf("symbolAliases key %q is not in prefix_code.market form, e.g. tse_2330.tw", symbol)
+		}
+		if alias == "" || !utf8.ValidString(alias) {
+			return fmt.Errorf("symbolAliases value %q of %s is not a valid label value", alias, symbol)
+		}
+	}
+	for name := range c.StaticLabels {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("staticLabels name %q is not a valid label name", name)
+		}
+		if slices.Contains(reservedLabels, name) {
+			return fmt.Errorf("staticLabels name %q is used by the exporter", name)
+		}
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != "" && c.LogFormat != "json" && c.LogFormat != "text" {
+		return fmt.Errorf("logFormat %q is not json or text", c.LogFormat)
+	}
+	// 0 leaves the port to -web.listen-address or the default
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("port %d out of range 1-65535", c.Port)
+	}
+
+	return nil
+}
+
+// helpTemplate parses HelpTemplate and tries it on every per-stock series,
+// it returns nil when unset
+func (c *Config) helpTemplate() (*template.Template, error) {
+	if c.HelpTemplate == "" {
+		return nil, nil
+	}
+	t, err := template.New("help").Option("missingkey=error").Parse(c.HelpTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("bad helpTemplate: %v", err)
+	}
+	for _, name := range twse.StockMetricNames {
+		if err := t.Execute(io.Discard, twse.HelpData{Name: name}); err != nil {
+			return nil, fmt.Errorf("bad helpTemplate: %v", err)
+		}
+	}
+	return t, nil
+}
+
+// parseProxyURL parses a proxy URL in a scheme net/http can dial
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxyURL %q: %v", s, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxyURL %q is not http(s):// or socks5://", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxyURL %q has no host", s)
+	}
+	return u, nil
+}
+
+const (
+	// configEnv holds the YAML config body, as an alternative to a file
+	configEnv = "TWSE_CONFIG"
+	// exChListEnv holds comma separated symbols overriding exChList, so
+	// the exporter runs without a config file
+	exChListEnv = "TWSE_EXCHLIST"
+)
+
+// configSource is where the config is read from, on start and on reload
+type configSource struct {
+	path string
+	// content is the YAML body given inline, it takes precedence over path
+	content string
+}
+
+// newConfigSource picks the config from content, then the TWSE_CONFIG env,
+// then the file at path. A path of "-" reads stdin once, so reloads
+// reuse what was read.
+func newConfigSource(path, content string) (*configSource, error) {
+	if content == "" {
+		content = os.Getenv(configEnv)
+	}
+	if content == "" && path == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config from stdin: %v", err)
+		}
+		content = string(b)
+	}
+
+	return &configSource{path: path, content: content}, nil
+}
+
+func (s *configSource) String() string {
+	if s.content != "" {
+		return "inline config"
+	}
+	return s.path
+}
+
+// load reads, decodes and validates the config. Inline content is YAML,
+// which JSON also is.
+func (s *configSource) load() (*Config, error) {
+	if s.content != "" {
+		return parseConfig(strings.NewReader(s.content), "yaml")
+	}
+	return loadConfig(s.path)
+}
+
+// loadConfig reads and decodes the config file at path, as JSON for a
+// .json extension and as YAML otherwise
+func loadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if os.Getenv(exChListEnv) == "" {
+			return nil, fmt.Errorf("config file %s not found, copy config.yaml.example there, or set %s or %s", path, configEnv, exChListEnv)
+		}
+		slog.Info("Config file not found, using the defaults", "path", path, "env", exChListEnv)
+		return parseConfig(strings.NewReader(""), "yaml")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer file.Close()
+
+	format := "yaml"
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		format = "json"
+	case ".yaml", ".yml":
+	default:
+		slog.Warn("Unknown config extension, decoding as YAML", "path", path, "ext", ext)
+	}
+
+	return parseConfig(file, format)
+}
+
+// parseConfig decodes the config read from r in format, json or yaml,
+// and validates it
+func parseConfig(r io.Reader, format string) (*Config, error) {
+	// 解析配置文件
+	var config Config
+	var err error
+	if format == "json" {
+		err = json.NewDecoder(r).Decode(&config)
+	} else {
+		err = yaml.NewDecoder(r).Decode(&config)
+	}
+	// An empty config leaves everything to the defaults and env
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+	if env := os.Getenv(exChListEnv); env != "" {
+		config.ExChList = strings.FieldsFunc(env, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	config.ExChList = normalizeExChList(config.ExChList)
+	if len(config.SymbolAliases) > 0 {
+		aliases := make(map[string]string, len(config.SymbolAliases))
+		for symbol, alias := range config.SymbolAliases {
+			aliases[normalizeSymbol(symbol)] = alias
+		}
+		config.SymbolAliases = aliases
+	}
+	if config.BaselineFile != "" {
+		if config.baselines, err = loadBaselines(config.BaselineFile); err != nil {
+			return nil, err
+		}
+	}
+	// Fetch the symbols of every group too, in a stable order
+	names := make([]string, 0, len(config.Groups))
+	for name := range config.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		config.Groups[name] = normalizeExChList(config.Groups[name])
+		for _, symbol := range config.Groups[name] {
+			if !slices.Contains(config.ExChList, symbol) {
+				config.ExChList = append(config.ExChList, symbol)
+			}
+		}
+	}
+
+	return &config, nil
+}
+
+// normalizeExChList lowercases the exchange prefix and market suffix of
+// each validated entry, as TWSE returns them, and drops duplicates
+// keeping the first.
+func normalizeExChList(list []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, symbol := range list {
+		symbol = normalizeSymbol(symbol)
+		if seen[symbol] {
+			slog.Warn("Drop duplicated exChList entry", "symbol", symbol)
+			continue
+		}
+		seen[symbol] = true
+		normalized = append(normalized, symbol)
+	}
+	return normalized
+}
+
+// normalizeSymbol lowercases the exchange prefix and market suffix of a
+// validated symbol, e.g. TSE_2330.TW becomes tse_2330.tw
+func normalizeSymbol(symbol string) string {
+	prefix, rest, _ := strings.Cut(symbol, "_")
+	dot := strings.LastIndex(rest, ".")
+	return strings.ToLower(prefix) + "_" + rest[:dot] + strings.ToLower(rest[dot:])
+}
+
+// reloadConfig loads the config from source and applies it. On error the
+// running config is kept.
+func reloadConfig(source *configSource) error {
+	config, err := source.load()
+	if err != nil {
+		slog.Error("Failed to reload config, keeping the old one", "err", err)
+		return err
+	}
+	applyConfig(config)
+	slog.Info("Reloaded config", "source", source.String())
+	return nil
+}
+
+// reloadHandler reloads the config on POST, answering 400 with the error
+// when it is invalid
+func reloadHandler(source *configSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(source); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK\n"))
+	})
+}
+
+// applyConfig swaps in the runtime-safe settings of config. The listen
+// address, shutdown timeout, TLS and basic auth only take effect on restart.
+func applyConfig(config *Config) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	exChList = config.ExChList
+	groups = config.Groups
+
+	// Keep the limiter of an unchanged rateLimit, so reloads do not reset
+	// its budget
+	if config.RateLimit <= 0 {
+		limiter = nil
+	} else if limit := rate.Limit(config.RateLimit / 60); limiter == nil || limiter.Limit() != limit {
+		limiter = rate.NewLimiter(limit, rateBurst(config))
+	} else {
+		limiter.SetBurst(rateBurst(config))
+	}
+	stockFetcher = newFetcher(config)
+	stockFetcher.Limiter = limiter
+
+	maxStaleness = time.Duration(config.MaxStaleness)
+
+	marketHoursOnly = config.MarketHoursOnly
+	calendar = newMarketCalendar(config.Holidays)
+
+	cacheTTL = defaultCacheTTL
+	if config.CacheTTL > 0 {
+		cacheTTL = time.Duration(config.CacheTTL)
+	}
+
+	// Validate has checked the level
+	level, _ := parseLogLevel(config.LogLevel)
+	if debug {
+		level = slog.LevelDebug
+	}
+	logLevel.Set(level)
+
+	opts := twse.DefaultOptions()
+	opts.Include = config.Include
+	opts.Exclude = config.Exclude
+	opts.FailOnTotalOutage = config.FailOnTotalOutage
+	opts.Symbols = config.ExChList
+	opts.InfoLabels = config.InfoLabels
+	opts.Aliases = config.SymbolAliases
+	opts.Baselines = config.baselines
+	opts.SampleTimestamps = config.SampleTimestamps
+	opts.MaxSeries = config.MaxSeries
+	if config.PriceDecimals != nil {
+		opts.PriceDecimals = *config.PriceDecimals
+	}
+	if config.EmitZeroValues != nil {
+		opts.EmitZeroValues = *config.EmitZeroValues
+	}
+	if len(config.Metrics) > 0 {
+		opts.Metrics = make(map[string]bool)
+		for _, name := range config.Metrics {
+			opts.Metrics[name] = true
+		}
+	}
+	if config.LimitEpsilon > 0 {
+		opts.LimitEpsilon = config.LimitEpsilon
+	}
+	if config.StaleThreshold > 0 {
+		opts.StaleThreshold = time.Duration(config.StaleThreshold)
+	}
+	stockMetrics.SetOptions(opts)
+
+	// Symbols may have changed, force a fetch on the next scrape, or
+	// right away rather than on the next tick of runRefresher
+	resetCache()
+	if backgroundRefresh {
+		select {
+		case refreshNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// rateBurst is the burst of the rateLimit limiter, the requests of one
+// fetch of exChList: a request per chunk, and one more per chunk priming
+// the session
+func rateBurst(config *Config) int {
+	chunkSize := twse.DefaultChunkSize
+	if config.ChunkSize > 0 {
+		chunkSize = config.ChunkSize
+	}
+	burst := (len(config.ExChList) + chunkSize - 1) / chunkSize
+	if config.PrimeSession {
+		burst *= 2
+	}
+	return max(burst, 1)
+}
+
+// newFetcher sets up the fetcher of config, with its transport to TWSE
+func newFetcher(config *Config) *twse.Fetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.ProxyURL != "" {
+		// Validate has checked the URL
+		proxy, _ := parseProxyURL(config.ProxyURL)
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+	}
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(config.IdleConnTimeout)
+	}
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	client := &http.Client{Timeout: twse.DefaultTimeout, Transport: transport}
+	if config.Timeout > 0 {
+		client.Timeout = time.Duration(config.Timeout)
+	}
+	if config.PrimeSession {
+		// cookiejar.New never fails with nil options
+		client.Jar, _ = cookiejar.New(nil)
+	}
+
+	baseURLs := config.UpstreamURLs
+	if len(baseURLs) == 0 {
+		baseURLs = []string{twse.DefaultBaseURL}
+		if config.BaseURL != "" {
+			baseURLs = []string{config.BaseURL}
+		}
+	}
+	f := twse.NewFetcher(client, baseURLs...)
+	f.UserAgent = "twse_exporter/" + version
+	if config.MaxRetries != nil {
+		f.MaxRetries = *config.MaxRetries
+	}
+	if config.UserAgent != "" {
+		f.UserAgent = config.UserAgent
+	}
+	if config.ChunkSize > 0 {
+		f.ChunkSize = config.ChunkSize
+	}
+	if config.MaxConcurrency > 0 {
+		f.MaxConcurrency = config.MaxConcurrency
+	}
+	if config.MaxResponseBytes > 0 {
+		f.MaxResponseBytes = config.MaxResponseBytes
+	}
+	f.PrimeSession = config.PrimeSession
+	return f
+}
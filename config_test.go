@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elleryq/twse_exporter/twse"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		// wantErr is a part of the error, empty for none
+		wantErr string
+	}{
+		{"valid", Config{ExChList: []string{"tse_2330.tw", "otc_6488.tw"}, Port: 9100}, ""},
+		{"no port", Config{ExChList: []string{"tse_2330.tw"}}, ""},
+		{"empty exChList", Config{Port: 9100}, "exChList is empty"},
+		{"no exchange", Config{ExChList: []string{"2330.tw"}}, `"2330.tw" is not in prefix_code.market form`},
+		{"no market", Config{ExChList: []string{"tse_2330"}}, `"tse_2330" is not in prefix_code.market form`},
+		{"empty code", Config{ExChList: []string{"tse_.tw"}}, `"tse_.tw" is not in prefix_code.market form`},
+		{"space", Config{ExChList: []string{"tse_2330.tw "}}, `"tse_2330.tw " is not in prefix_code.market form`},
+		{"pipe", Config{ExChList: []string{"tse_2330.tw|otc_6488.tw"}}, "is not in prefix_code.market form"},
+		{"empty entry", Config{ExChList: []string{"tse_2330.tw", ""}}, `"" is not in prefix_code.market form`},
+		{"bad group entry", Config{Groups: map[string][]string{"semi": {"2330"}}}, `group "semi" entry "2330"`},
+		{"negative port", Config{ExChList: []string{"tse_2330.tw"}, Port: -1}, "port -1 out of range"},
+		{"port too large", Config{ExChList: []string{"tse_2330.tw"}, Port: 65536}, "port 65536 out of range"},
+		{"negative maxRetries", Config{ExChList: []string{"tse_2330.tw"}, MaxRetries: intPtr(-1)}, "maxRetries -1 must not be negative"},
+		{"no retries", Config{ExChList: []string{"tse_2330.tw"}, MaxRetries: intPtr(0)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	t.Setenv(exChListEnv, "")
+	files := map[string]string{
+		"config.yaml": `
+exChList: [tse_2330.tw, otc_6488.tw]
+port: 9200
+timeout: 5s
+maxRetries: 0
+cacheTTL: 1m30s
+emitZeroValues: false
+symbolAliases:
+  tse_2330.tw: TSMC
+tls:
+  certFile: cert.pem
+  keyFile: key.pem
+`,
+		"config.json": `{
+  "exChList": ["tse_2330.tw", "otc_6488.tw"],
+  "port": 9200,
+  "timeout": "5s",
+  "maxRetries": 0,
+  "cacheTTL": "1m30s",
+  "emitZeroValues": false,
+  "symbolAliases": {"tse_2330.tw": "TSMC"},
+  "tls": {"certFile": "cert.pem", "keyFile": "key.pem"}
+}`,
+		// Unknown extensions are decoded as YAML
+		"config.conf": "exChList: [tse_2330.tw, otc_6488.tw]\nport: 9200\n",
+	}
+	dir := t.TempDir()
+	configs := make(map[string]*Config)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("loadConfig(%s) error = %v", name, err)
+		}
+		configs[name] = config
+	}
+
+	if !reflect.DeepEqual(configs["config.json"], configs["config.yaml"]) {
+		t.Errorf("JSON config = %+v, want the YAML %+v", configs["config.json"], configs["config.yaml"])
+	}
+	yamlConfig := configs["config.yaml"]
+	if time.Duration(yamlConfig.CacheTTL) != 90*time.Second || yamlConfig.MaxRetries == nil || *yamlConfig.MaxRetries != 0 {
+		t.Errorf("cacheTTL = %v, maxRetries = %v, want 1m30s, 0", time.Duration(yamlConfig.CacheTTL), yamlConfig.MaxRetries)
+	}
+	if conf := configs["config.conf"]; conf.Port != 9200 || len(conf.ExChList) != 2 {
+		t.Errorf("config.conf = %+v, want it decoded as YAML", conf)
+	}
+}
+
+func TestNewFetcherProxy(t *testing.T) {
+	var proxied atomic.Value
+	payload := serveFile(t, testPayload)
+	// A forward proxy gets the absolute URL of the upstream
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		payload(w, r)
+	}))
+	defer proxy.Close()
+
+	f := newFetcher(&Config{BaseURL: "http://mis.twse.invalid/stock", ProxyURL: proxy.URL, MaxRetries: intPtr(0)})
+	stockInfos, err := f.FetchStockInfo(context.Background(), testSymbols)
+	if err != nil || len(stockInfos) != len(testSymbols) {
+		t.Fatalf("FetchStockInfo() = %d stocks, %v, want %d stocks", len(stockInfos), err, len(testSymbols))
+	}
+	want := "http://mis.twse.invalid/stock/api/getStockInfo.jsp?ex_ch=" + strings.Join(testSymbols, "|")
+	if got, _ := proxied.Load().(string); got != want {
+		t.Errorf("proxy got %q, want %q", got, want)
+	}
+}
+
+func TestNewFetcherTransport(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            Config
+		maxIdleConns      int
+		idleConnTimeout   time.Duration
+		disableKeepAlives bool
+		timeout           time.Duration
+	}{
+		{
+			name:            "defaults",
+			maxIdleConns:    http.DefaultTransport.(*http.Transport).MaxIdleConns,
+			idleConnTimeout: defaultIdleConnTimeout,
+			timeout:         twse.DefaultTimeout,
+		},
+		{
+			name: "configured",
+			config: Config{
+				MaxIdleConns:      7,
+				IdleConnTimeout:   Duration(45 * time.Second),
+				DisableKeepAlives: true,
+				Timeout:           Duration(3 * time.Second),
+			},
+			maxIdleConns:      7,
+			idleConnTimeout:   45 * time.Second,
+			disableKeepAlives: true,
+			timeout:           3 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFetcher(&tt.config).Client
+			transport := client.Transport.(*http.Transport)
+			if transport.MaxIdleConns != tt.maxIdleConns {
+				t.Errorf("MaxIdleConns = %d, want %d", transport.MaxIdleConns, tt.maxIdleConns)
+			}
+			if transport.IdleConnTimeout != tt.idleConnTimeout {
+				t.Errorf("IdleConnTimeout = %v, want %v", transport.IdleConnTimeout, tt.idleConnTimeout)
+			}
+			if transport.DisableKeepAlives != tt.disableKeepAlives {
+				t.Errorf("DisableKeepAlives = %v, want %v", transport.DisableKeepAlives, tt.disableKeepAlives)
+			}
+			if client.Timeout != tt.timeout {
+				t.Errorf("Timeout = %v, want %v", client.Timeout, tt.timeout)
+			}
+			// Tuning the transport must not touch the shared default
+			if transport == http.DefaultTransport {
+				t.Error("newFetcher() uses http.DefaultTransport")
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	// Nothing else set, fail with guidance
+	t.Setenv(exChListEnv, "")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "copy config.yaml.example") || !strings.Contains(err.Error(), exChListEnv) {
+		t.Errorf("loadConfig() error = %v, want the guidance", err)
+	}
+
+	// The symbols from the env, the rest defaults
+	t.Setenv(exChListEnv, "tse_2330.tw, OTC_6488.TW")
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if want := []string{"tse_2330.tw", "otc_6488.tw"}; !reflect.DeepEqual(config.ExChList, want) {
+		t.Errorf("exChList = %q, want %q", config.ExChList, want)
+	}
+	if config.Port != 0 || config.MaxRetries != nil {
+		t.Errorf("config = %+v, want the defaults", config)
+	}
+
+	// Invalid symbols from the env still fail
+	t.Setenv(exChListEnv, "2330")
+	if _, err := loadConfig(path); err == nil {
+		t.Error("loadConfig() of a bad env exChList succeeded, want an error")
+	}
+}
+
+func TestLoadBaselines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{"baselines.yaml", "tse_2330.tw: 600\nOTC_6488.TW: 411.5\n", map[string]float64{"tse_2330.tw": 600, "otc_6488.tw": 411.5}, false},
+		{"baselines.csv", "symbol,price\ntse_2330.tw, 600\n", map[string]float64{"tse_2330.tw": 600}, false},
+		{"empty.yaml", "", map[string]float64{}, false},
+		{"empty.csv", "", map[string]float64{}, false},
+		{"symbol.yaml", "2330: 600\n", nil, true},
+		{"price.csv", "tse_2330.tw,n/a\n", nil, true},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadBaselines(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadBaselines() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadBaselines() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
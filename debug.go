@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/elleryq/twse_exporter/twse"
+)
+
+// debugStocksHandler serves the cached stock info as decoded from TWSE,
+// as JSON or as CSV with ?format=csv. It never fetches from TWSE.
+func debugStocksHandler(w http.ResponseWriter, r *http.Request) {
+	cacheMutex.RLock()
+	var stockInfos []twse.StockInfo
+	for _, stock := range cachedStocks() {
+		stockInfos = append(stockInfos, stock.Info)
+	}
+	cacheMutex.RUnlock()
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writeStocksCSV(w, stockInfos)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(stockInfos)
+}
+
+// writeStocksCSV writes stockInfos with the JSON field names as header
+func writeStocksCSV(w io.Writer, stockInfos []twse.StockInfo) {
+	t := reflect.TypeOf(twse.StockInfo{})
+	header := make([]string, t.NumField())
+	for i := range header {
+		header[i] = t.Field(i).Tag.Get("json")
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, info := range stockInfos {
+		v := reflect.ValueOf(info)
+		record := make([]string, v.NumField())
+		for i := range record {
+			record[i] = v.Field(i).String()
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+}
@@ -1,8 +1,13 @@
 module github.com/elleryq/twse_exporter
 
-go 1.18
+go 1.21
 
-require github.com/prometheus/client_golang v1.20.5
+require (
+	github.com/prometheus/client_golang v1.20.5
+	golang.org/x/crypto v0.21.0
+	golang.org/x/sync v0.7.0
+	golang.org/x/time v0.5.0
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logLevel is shared by the log handlers so reloads can change it
+var logLevel = new(slog.LevelVar)
+
+// newLogHandler returns a handler writing to w at logLevel, as JSON or
+// as text for local development when format is "text"
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// parseLogLevel parses debug, info, warn or error, "" means info
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
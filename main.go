@@ -1,197 +1,244 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
-
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"gopkg.in/yaml.v2"
 )
 
-type StockInfo struct {
-	At      string `json:"@"`
-	Tv      string `json:"tv"`
-	Ps      string `json:"ps"`
-	Nu      string `json:"nu"`
-	Pid     string `json:"pid"`
-	Pz      string `json:"pz"`
-	Bp      string `json:"bp"`
-	Fv      string `json:"fv"`
-	Oa      string `json:"oa"`
-	Ob      string `json:"ob"`
-	M       string `json:"m%"`
-	Key     string `json:"key"`
-	Caret   string `json:"^"`
-	A       string `json:"a"`
-	B       string `json:"b"`
-	C       string `json:"c"`
-	Hash    string `json:"#"`
-	D       string `json:"d"`
-	Percent string `json:"%"`
-	Ch      string `json:"ch"`
-	Tlong   string `json:"tlong"`
-	Ot      string `json:"ot"`
-	F       string `json:"f"`
-	G       string `json:"g"`
-	Ip      string `json:"ip"`
-	Mt      string `json:"mt"`
-	Ov      string `json:"ov"`
-	H       string `json:"h"`
-	It      string `json:"it"`
-	Oz      string `json:"oz"`
-	L       string `json:"l"`
-	N       string `json:"n"`
-	O       string `json:"o"`
-	P       string `json:"p"`
-	Ex      string `json:"ex"`
-	S       string `json:"s"`
-	T       string `json:"t"`
-	U       string `json:"u"`
-	V       string `json:"v"`
-	W       string `json:"w"`
-	Nf      string `json:"nf"`
-	Y       string `json:"y"`
-	Z       string `json:"z"`
-	Ts      string `json:"ts"`
-}
-
-type Response struct {
-	MsgArray []StockInfo `json:"msgArray"`
-}
-
-type Config struct {
-	ExChList []string `yaml:"exChList"`
-	Address  string   `yaml:"address"`
-	Port     int      `yaml:"port"`
-}
+const defaultShutdownTimeout = 5 * time.Second
 
+// Injected at build time with -ldflags, see Makefile
 var (
-	cacheData      []StockInfo
-	cacheTimestamp time.Time
-	cacheMutex     sync.Mutex
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
-func fetchStockInfo(exChList []string) ([]StockInfo, error) {
-	// 將 string list 轉換為以 '|' 分隔的字串
-	exCh := strings.Join(exChList, "|")
+// debug forces the debug log level regardless of logLevel in config
+var debug bool
 
-	// construct url
-	url := fmt.Sprintf("http://mis.twse.com.tw/stock/api/getStockInfo.jsp?ex_ch=%s", exCh)
+const (
+	defaultListenAddress = ":9100"
+	defaultPort          = 9100
+	listenAddressEnv     = "TWSE_LISTEN_ADDRESS"
+	// unixScheme prefixes a listen address that is a Unix socket path
+	unixScheme = "unix://"
+)
 
-	// Send HTTP request
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Fatalf("Failed to fetch stock info: %v", err)
+// resolveListenAddress picks the listen address by precedence
+// flag > env > config > default, then validates it. It is either
+// host:port, with IPv6 hosts in brackets, or unix:///path/to/socket.
+func resolveListenAddress(flagValue string, config *Config) (string, error) {
+	address := defaultListenAddress
+	if flagValue != "" {
+		address = flagValue
+	} else if env := os.Getenv(listenAddressEnv); env != "" {
+		address = env
+	} else if strings.HasPrefix(config.Address, unixScheme) {
+		address = config.Address
+	} else if config.Address != "" || config.Port != 0 {
+		// An address without port keeps its host, on the default port
+		port := config.Port
+		if port == 0 {
+			port = defaultPort
+		}
+		address = net.JoinHostPort(config.Address, strconv.Itoa(port))
 	}
-	defer resp.Body.Close()
 
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Failed to read response body: %v", err)
+	if path, ok := strings.CutPrefix(address, unixScheme); ok {
+		if !filepath.IsAbs(path) {
+			return "", fmt.Errorf("unix socket path %q is not absolute", path)
+		}
+		return address, nil
 	}
 
-	// 解析 JSON 响应
-	var response Response
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	// Drop the zone of a link-local IPv6 address, e.g. fe80::1%eth0
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return "", fmt.Errorf("unknown host %q", host)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("port %q out of range 1-65535", port)
 	}
 
-	return response.MsgArray, nil
+	return address, nil
 }
 
-func getCachedStockInfo(exChList []string) ([]StockInfo, error) {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-
-	if time.Since(cacheTimestamp) < 5*time.Second {
-		return cacheData, nil
+// listen opens the resolved listen address. A stale Unix socket left by
+// a previous run is removed first.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixScheme)
+	if !ok {
+		return net.Listen("tcp", address)
 	}
-
-	stockInfos, err := fetchStockInfo(exChList)
-	if err != nil {
-		return nil, err
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
 	}
-
-	cacheData = stockInfos
-	cacheTimestamp = time.Now()
-
-	return stockInfos, nil
+	return net.Listen("unix", path)
 }
 
 func main() {
 	// 解析命令行参数
-	configFile := flag.String("config", "config.yaml", "Path to the config file")
+	configFile := flag.String("config", "config.yaml", "Path to the config file, - reads stdin")
+	configContent := flag.String("config.content", "", "YAML config body, overrides "+configEnv+" and -config")
+	webListenAddress := flag.String("web.listen-address", "", "Address to listen on, overrides "+listenAddressEnv+" and the config file")
+	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
+	checkOnly := flag.Bool("check", false, "Fetch once, print the metrics and exit, non-zero on failure")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [symbols <code>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, "")))
+
 	// 读取配置文件
-	file, err := os.Open(*configFile)
+	source, err := newConfigSource(*configFile, *configContent)
 	if err != nil {
-		log.Fatalf("Failed to open config file: %v", err)
+		fatal("Failed to read config", "err", err)
 	}
-	defer file.Close()
 
-	// 解析配置文件
-	var config Config
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		log.Fatalf("Failed to decode config file: %v", err)
+	// symbols <code>... looks codes up instead of serving
+	if flag.Arg(0) == "symbols" {
+		// A code is expected to be missing under one of the prefixes
+		if !debug {
+			logLevel.Set(slog.LevelError)
+		}
+		f, err := symbolsFetcher(source)
+		if err != nil {
+			fatal("Failed to load config", "err", err)
+		}
+		if err := runSymbols(context.Background(), os.Stdout, f, flag.Args()[1:]); err != nil {
+			fatal("Symbol lookup failed", "err", err)
+		}
+		return
 	}
 
-	// Create HTTP handler to expose metrics
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		// 使用 exChList
-		stockInfos, err := getCachedStockInfo(config.ExChList)
-		if err != nil {
-			log.Printf("Error fetching stock info: %v", err)
-			http.Error(w, "Failed to fetch stock info", http.StatusInternalServerError)
-			return
+	config, err := source.load()
+	if err != nil {
+		fatal("Failed to load config", "err", err)
+	}
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, config.LogFormat)))
+	// Validate has checked the template
+	helpTemplate, _ := config.helpTemplate()
+	registerMetrics(config.MetricPrefix, helpTemplate, config.StaticLabels)
+	applyConfig(config)
+
+	if *checkOnly {
+		if err := runCheck(os.Stdout); err != nil {
+			fatal("Check failed", "err", err)
 		}
+		return
+	}
 
-		// Create registry
-		registry := prometheus.NewRegistry()
-
-		for _, info := range stockInfos {
-			metricName := fmt.Sprintf("%s_%s_gauge", info.Ex, info.C)
-			metricHelp := fmt.Sprintf("%s_%s於%s %s的價格%s", info.Ex, info.At, info.D, info.Percent, info.Pz)
-			// Create gauge
-			gaugeMetric := prometheus.NewGauge(prometheus.GaugeOpts{
-				Name: metricName, // metric name
-				Help: metricHelp, // metric help
-			})
-
-			// Convert Pz to float64
-			price, err := strconv.ParseFloat(info.Pz, 64)
-			if err != nil {
-				log.Printf("Failed to parse price: %v", err)
-				http.Error(w, "Failed to parse price", http.StatusInternalServerError)
-				return
-			}
-
-			// Set value
-			gaugeMetric.Set(price)
-
-			// register gauge
-			registry.MustRegister(gaugeMetric)
+	// Reload runtime settings on SIGHUP
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			reloadConfig(source)
 		}
+	}()
+
+	// Create HTTP handler to expose metrics, in OpenMetrics when negotiated
+	http.Handle("/metrics", basicAuth(config.BasicAuth, metricsHandler(stockMetrics, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	http.Handle("/metrics/", basicAuth(config.BasicAuth, groupMetricsHandler(stockMetrics, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	http.Handle("/probe", basicAuth(config.BasicAuth, probeHandler(stockMetrics, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+
+	// Reload like SIGHUP, for setups where signals are inconvenient
+	http.Handle("/-/reload", basicAuth(config.BasicAuth, reloadHandler(source)))
 
-		// Use promhttp.HandlerFor
-		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-		h.ServeHTTP(w, r)
+	// Raw stock info behind the metrics
+	http.Handle("/debug/stocks", basicAuth(config.BasicAuth, http.HandlerFunc(debugStocksHandler)))
+
+	// Liveness probe, independent of TWSE being reachable
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK\n"))
 	})
 
 	// Start web server
-	listenAddress := fmt.Sprintf("%s:%d", config.Address, config.Port)
-	http.ListenAndServe(listenAddress, nil)
+	listenAddress, err := resolveListenAddress(*webListenAddress, config)
+	if err != nil {
+		fatal("Invalid listen address", "err", err)
+	}
+	listener, err := listen(listenAddress)
+	if err != nil {
+		fatal("Failed to listen", "address", listenAddress, "err", err)
+	}
+	server := &http.Server{}
+
+	// Check the certificate up front rather than on the first handshake
+	useTLS := config.TLS.CertFile != "" && config.TLS.KeyFile != ""
+	if useTLS {
+		if _, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile); err != nil {
+			fatal("Failed to load TLS certificate", "err", err)
+		}
+	}
+
+	// Prime the cache before serving scrapes, once the listen address and
+	// certificate are known to be good
+	warmUp(context.Background())
+
+	shutdownTimeout := defaultShutdownTimeout
+	if config.ShutdownTimeout > 0 {
+		shutdownTimeout = time.Duration(config.ShutdownTimeout)
+	}
+
+	// Keep the cache fresh in the background when configured
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	defer stopRefresh()
+	if config.RefreshInterval > 0 {
+		go runRefresher(refreshCtx, time.Duration(config.RefreshInterval))
+	}
+
+	// Let in-flight scrapes finish on SIGINT/SIGTERM
+	done := make(chan struct{})
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		slog.Info("Shutting down", "signal", sig.String())
+		stopRefresh()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shutdown gracefully", "err", err)
+		}
+		close(done)
+	}()
+
+	if useTLS {
+		err = server.ServeTLS(listener, config.TLS.CertFile, config.TLS.KeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		fatal("Failed to start server", "err", err)
+	}
+	<-done
+	slog.Info("Shutdown complete")
 }
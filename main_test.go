@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPayload is a getStockInfo.jsp response captured from MIS, with the
+// stocks of testSymbols
+const testPayload = "twse/testdata/getStockInfo.json"
+
+var testSymbols = []string{"tse_2330.tw", "otc_6488.tw", "tse_t00.tw"}
+
+func TestMain(m *testing.M) {
+	registerMetrics("", nil, nil)
+	os.Exit(m.Run())
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+// serveFile returns a handler answering with the file at path
+func serveFile(t *testing.T, path string) http.HandlerFunc {
+	t.Helper()
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}
+}
+
+// useUpstream applies config, by default fetching testSymbols without
+// retries, with a test server answering with handler as baseURL. The
+// defaults are applied again once the test is done.
+func useUpstream(t *testing.T, handler http.Handler, config *Config) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	if config == nil {
+		config = &Config{}
+	}
+	if config.ExChList == nil {
+		config.ExChList = testSymbols
+	}
+	if config.MaxRetries == nil {
+		config.MaxRetries = intPtr(0)
+	}
+	config.BaseURL = server.URL
+	applyConfig(config)
+	t.Cleanup(func() {
+		applyConfig(&Config{ExChList: testSymbols})
+	})
+	return server
+}
+
+// scrape GETs url from h
+func scrape(h http.Handler, url string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	return rec
+}
+
+func TestResolveListenAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		flag   string
+		env    string
+		config Config
+		want   string
+	}{
+		{name: "default", want: ":9100"},
+		{name: "config", config: Config{Address: "127.0.0.1", Port: 9200}, want: "127.0.0.1:9200"},
+		{name: "config port only", config: Config{Port: 9200}, want: ":9200"},
+		{name: "config address only", config: Config{Address: "127.0.0.1"}, want: "127.0.0.1:9100"},
+		{name: "env over config", env: "127.0.0.1:9300", config: Config{Port: 9200}, want: "127.0.0.1:9300"},
+		{name: "flag over env", flag: ":9400", env: "127.0.0.1:9300", config: Config{Port: 9200}, want: ":9400"},
+		{name: "IPv4", flag: "0.0.0.0:9100", want: "0.0.0.0:9100"},
+		{name: "IPv6", flag: "[::1]:9100", want: "[::1]:9100"},
+		{name: "IPv6 zone", flag: "[fe80::1%eth0]:9100", want: "[fe80::1%eth0]:9100"},
+		{name: "config IPv6", config: Config{Address: "::1", Port: 9200}, want: "[::1]:9200"},
+		{name: "unix socket", flag: "unix:///run/twse_exporter.sock", want: "unix:///run/twse_exporter.sock"},
+		{name: "config unix socket", config: Config{Address: "unix:///run/twse_exporter.sock", Port: 9200}, want: "unix:///run/twse_exporter.sock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(listenAddressEnv, tt.env)
+			got, err := resolveListenAddress(tt.flag, &tt.config)
+			if err != nil || got != tt.want {
+				t.Errorf("resolveListenAddress() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// exporterMetric returns the value of the exporter metric name with the
+// label name/value pairs, e.g. "reason", "decode"
+func exporterMetric(t *testing.T, name string, labels ...string) float64 {
+	t.Helper()
+	families, err := exporterRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			for i := 0; i+1 < len(labels); i += 2 {
+				found := false
+				for _, pair := range m.GetLabel() {
+					found = found || (pair.GetName() == labels[i] && pair.GetValue() == labels[i+1])
+				}
+				if !found {
+					continue metrics
+				}
+			}
+			switch {
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	t.Fatalf("no metric %s%q", name, labels)
+	return 0
+}
+
+func TestResolveListenAddressErrors(t *testing.T) {
+	t.Setenv(listenAddressEnv, "")
+	for _, address := range []string{
+		"::1:9100",
+		"127.0.0.1",
+		"127.0.0.1:0",
+		"127.0.0.1:65536",
+		"[::1]:http-alt",
+		"unix://twse_exporter.sock",
+	} {
+		if got, err := resolveListenAddress(address, &Config{}); err == nil {
+			t.Errorf("resolveListenAddress(%q) = %q, want an error", address, got)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "twse_exporter.sock")
+	// A socket left by a previous run that did not clean up
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	for _, tt := range []struct{ address, network string }{
+		{"127.0.0.1:0", "tcp"},
+		{"[::1]:0", "tcp"},
+		{unixScheme + socket, "unix"},
+	} {
+		l, err := listen(tt.address)
+		if err != nil {
+			if strings.HasPrefix(tt.address, "[") {
+				t.Logf("listen(%q) error = %v, no IPv6?", tt.address, err)
+				continue
+			}
+			t.Errorf("listen(%q) error = %v", tt.address, err)
+			continue
+		}
+		if got := l.Addr().Network(); got != tt.network {
+			t.Errorf("listen(%q) network = %q, want %q", tt.address, got, tt.network)
+		}
+		l.Close()
+	}
+}
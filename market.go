@@ -0,0 +1,54 @@
+package main
+
+import "time"
+
+// taipei is Asia/Taipei, which has no daylight saving time
+var taipei = time.FixedZone("Asia/Taipei", 8*60*60)
+
+// Trading hours in Asia/Taipei, in minutes since midnight
+const (
+	marketOpenMinute  = 9 * 60
+	marketCloseMinute = 13*60 + 30
+)
+
+// marketCalendar tells whether TWSE is trading at a given time
+type marketCalendar struct {
+	// holidays are non-trading weekdays as YYYY-MM-DD in Asia/Taipei
+	holidays map[string]bool
+}
+
+func newMarketCalendar(holidays []string) *marketCalendar {
+	c := &marketCalendar{holidays: make(map[string]bool)}
+	for _, day := range holidays {
+		c.holidays[day] = true
+	}
+	return c
+}
+
+// isOpen reports whether t falls within 09:00-13:30 of a trading day
+func (c *marketCalendar) isOpen(t time.Time) bool {
+	t = t.In(taipei)
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	if c.holidays[t.Format("2006-01-02")] {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	return minute >= marketOpenMinute && minute <= marketCloseMinute
+}
+
+var (
+	// marketHoursOnly and calendar are swapped on reload, guarded by cacheMutex
+	marketHoursOnly bool
+	calendar        = newMarketCalendar(nil)
+)
+
+// marketOpen reports whether TWSE is trading now
+func marketOpen() bool {
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+
+	return calendar.isOpen(time.Now())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/elleryq/twse_exporter/twse"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultMetricPrefix = "twse"
+
+// exporterRegistry holds the metrics of the exporter itself. It lives
+// across scrapes so counters accumulate, and is gathered after the stock
+// metrics so it already accounts for the fetch of the same scrape.
+var exporterRegistry = prometheus.NewRegistry()
+
+// stockMetrics is the collector of the stock metrics served on /metrics,
+// created by registerMetrics
+var stockMetrics *twse.Collector
+
+// staticLabels are added to every series, set by registerMetrics
+var staticLabels prometheus.Labels
+
+var (
+	buildInfo = newBuildInfo()
+
+	scrapeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "scrape_duration_seconds",
+		Help: "Duration of fetching stock info from TWSE",
+	})
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cache_hits_total",
+		Help: "Total number of scrapes served from cache",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cache_misses_total",
+		Help: "Total number of scrapes that fetched from TWSE",
+	})
+	cacheStale = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_stale",
+		Help: "1 if the stock metrics are served from cache because fetching from TWSE fails",
+	})
+	fetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fetch_errors_total",
+		Help: "Total number of failed fetches from TWSE, by reason",
+	}, []string{"reason"})
+	rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rate_limited_total",
+		Help: "Total number of fetches cut short by rateLimit, served from cache",
+	})
+	marketOpenGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "market_open",
+		Help: "Whether TWSE is within trading hours",
+	}, func() float64 {
+		if marketOpen() {
+			return 1
+		}
+		return 0
+	})
+)
+
+// registerMetrics names every metric with prefix and adds labels to it,
+// and renders the help of the stock metrics with helpTemplate when not
+// nil. It is called once on start, as registered metrics cannot be
+// renamed.
+func registerMetrics(prefix string, helpTemplate *template.Template, labels map[string]string) {
+	if prefix == "" {
+		prefix = defaultMetricPrefix
+	}
+	stockMetrics = twse.NewCollector(prefix, helpTemplate, getCachedStockInfo)
+	for _, reason := range twse.ErrorReasons {
+		fetchErrors.WithLabelValues(reason)
+	}
+	staticLabels = labels
+	registerer := prometheus.WrapRegistererWith(staticLabels, prometheus.WrapRegistererWithPrefix(prefix+"_", exporterRegistry))
+	twse.RegisterMetrics(registerer)
+	registerer.MustRegister(
+		buildInfo,
+		marketOpenGauge,
+		scrapeDuration,
+		cacheHits,
+		cacheMisses,
+		cacheStale,
+		fetchErrors,
+		rateLimited,
+	)
+}
+
+// metricsHandler serves the stock and exporter metrics. The collector is
+// bound to the request context, so a scrape cancelled by Prometheus also
+// cancels the upstream request.
+func metricsHandler(collector *twse.Collector, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry := prometheus.NewRegistry()
+		prometheus.WrapRegistererWith(staticLabels, registry).MustRegister(collector.WithContext(r.Context()))
+
+		// Collect reports a total outage as an error, which only fails
+		// the scrape with HTTPErrorOnError. opts is shared by every
+		// request, so it is changed on a copy.
+		o := opts
+		if collector.Options().FailOnTotalOutage {
+			o.ErrorHandling = promhttp.HTTPErrorOnError
+		}
+		h := promhttp.HandlerFor(prometheus.Gatherers{registry, exporterRegistry}, o)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// groupMetricsHandler serves /metrics/<group> like metricsHandler, with
+// the stock metrics of the symbols of the group. They come from the same
+// cache as /metrics.
+func groupMetricsHandler(collector *twse.Collector, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		symbols, ok := groupSymbols(strings.TrimPrefix(r.URL.Path, "/metrics/"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		metricsHandler(collector.WithSymbols(symbols), opts).ServeHTTP(w, r)
+	})
+}
+
+// newBuildInfo returns the constant 1 build_info gauge
+func newBuildInfo() prometheus.Gauge {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "build_info",
+		Help: "Build information of twse_exporter",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"revision":  commit,
+			"builddate": buildDate,
+			"goversion": runtime.Version(),
+		},
+	})
+	gauge.Set(1)
+	return gauge
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elleryq/twse_exporter/twse"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsHandlerFailOnTotalOutage(t *testing.T) {
+	down := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	})
+	server := useUpstream(t, down, &Config{FailOnTotalOutage: true})
+	h := metricsHandler(stockMetrics, promhttp.HandlerOpts{})
+
+	// Concurrent scrapes share the handler options
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := scrape(h, "/metrics"); rec.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want 500 on total outage", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Turning failOnTotalOutage off on reload applies to the same handler
+	applyConfig(&Config{ExChList: testSymbols, BaseURL: server.URL, MaxRetries: intPtr(0)})
+	if rec := scrape(h, "/metrics"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d after reload, want 200", rec.Code)
+	}
+}
+
+func TestMetricsHandlerUpstreamDown(t *testing.T) {
+	server := useUpstream(t, serveFile(t, testPayload), nil)
+	// Connections to a closed server are refused
+	server.Close()
+
+	rec := scrape(metricsHandler(stockMetrics, promhttp.HandlerOpts{}), "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "\ntwse_up 0\n") {
+		t.Errorf("no twse_up 0 in:\n%s", rec.Body)
+	}
+}
+
+func TestMetricsHandlerDuplicates(t *testing.T) {
+	body, err := os.ReadFile(testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response twse.Response
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	// TWSE repeats the rows of repeated symbols
+	response.MsgArray = append(response.MsgArray, response.MsgArray[0])
+	duplicated := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(response)
+	})
+	useUpstream(t, duplicated, &Config{ExChList: append(testSymbols, testSymbols[0])})
+
+	rec := scrape(metricsHandler(stockMetrics, promhttp.HandlerOpts{}), "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200:\n%s", rec.Code, rec.Body)
+	}
+	if n := strings.Count(rec.Body.String(), "\ntwse_stock_prev_close{"); n != 2 {
+		t.Errorf("got %d stock_prev_close series, want 2", n)
+	}
+	if n := strings.Count(rec.Body.String(), "\ntwse_stock_up{"); n != 2 {
+		t.Errorf("got %d stock_up series, want 2", n)
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	useUpstream(t, serveFile(t, testPayload), nil)
+	h := metricsHandler(stockMetrics, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+	tests := []struct {
+		name, accept, wantType, wantEnd string
+	}{
+		{"openmetrics", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5", "application/openmetrics-text", "# EOF\n"},
+		{"text", "text/plain;version=0.0.4", "text/plain; version=0.0.4", "\n"},
+		{"no accept", "", "text/plain; version=0.0.4", "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.wantType)
+			}
+			body := rec.Body.String()
+			if !strings.HasSuffix(body, tt.wantEnd) || (tt.wantEnd != "# EOF\n" && strings.Contains(body, "# EOF")) {
+				t.Errorf("body does not end with %q", tt.wantEnd)
+			}
+			if !strings.Contains(body, `twse_stock_price{`) {
+				t.Errorf("no stock_price in:\n%s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/elleryq/twse_exporter/twse"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeHandler serves /probe?target=tse_2330.tw with the stock metrics of
+// the target alone, fetched from TWSE on every probe, following the
+// multi-target exporter pattern. The target need not be in exChList and
+// is never cached.
+func probeHandler(collector *twse.Collector, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		if !symbolPattern.MatchString(target) {
+			http.Error(w, fmt.Sprintf("target %q is not in prefix_code.market form, e.g. tse_2330.tw", target), http.StatusBadRequest)
+			return
+		}
+		target = normalizeSymbol(target)
+
+		c := collector.WithSource(probeSource(target)).WithSymbols([]string{target}).WithContext(r.Context())
+		registry := prometheus.NewRegistry()
+		prometheus.WrapRegistererWith(staticLabels, registry).MustRegister(c)
+
+		o := opts
+		if collector.Options().FailOnTotalOutage {
+			o.ErrorHandling = promhttp.HTTPErrorOnError
+		}
+		promhttp.HandlerFor(registry, o).ServeHTTP(w, r)
+	})
+}
+
+// probeSource returns the twse.Source of a probe of target, which fetches
+// it with stockFetcher, subject to rateLimit. The symbol counts stay those
+// of the exChList fetch.
+func probeSource(target string) twse.Source {
+	return func(ctx context.Context) ([]twse.CachedStock, time.Time, error) {
+		cacheMutex.RLock()
+		f := *stockFetcher
+		cacheMutex.RUnlock()
+		f.SkipSymbolCounts = true
+
+		stockInfos, err := f.FetchStockInfo(ctx, []string{target})
+		if errors.Is(err, twse.ErrRateLimited) {
+			rateLimited.Inc()
+		} else if err != nil {
+			fetchErrors.WithLabelValues(twse.ErrorReason(err)).Inc()
+		}
+		if len(stockInfos) == 0 {
+			return nil, time.Time{}, err
+		}
+		now := time.Now()
+		var stocks []twse.CachedStock
+		for _, info := range stockInfos {
+			stocks = append(stocks, twse.CachedStock{Info: info, FetchedAt: now})
+		}
+		slog.Debug("Probed stock info", "target", target)
+		return stocks, now, err
+	}
+}
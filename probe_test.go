@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestProbeHandler(t *testing.T) {
+	var exCh []string
+	payload := serveFile(t, testPayload)
+	useUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exCh = append(exCh, r.URL.Query().Get("ex_ch"))
+		payload(w, r)
+	}), &Config{ExChList: []string{"tse_2330.tw", "tse_t00.tw"}})
+	metrics := metricsHandler(stockMetrics, promhttp.HandlerOpts{})
+	probe := probeHandler(stockMetrics, promhttp.HandlerOpts{})
+
+	if rec := scrape(metrics, "/metrics"); !strings.Contains(rec.Body.String(), "twse_symbols_requested 2\n") {
+		t.Fatalf("/metrics has no twse_symbols_requested 2:\n%s", rec.Body)
+	}
+
+	// A target outside exChList, in any case
+	exCh = nil
+	rec := scrape(probe, "/probe?target=OTC_6488.TW")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if len(exCh) != 1 || exCh[0] != "otc_6488.tw" {
+		t.Errorf("probe requested ex_ch %q, want only otc_6488.tw", exCh)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`twse_stock_up{code="6488",exchange="otc"} 1`,
+		`twse_stock_prev_close{alias="",code="6488",currency="TWD",exchange="otc",market="otc",name="環球晶",suffix="tw"} 411.5`,
+		"twse_up 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("probe has no %s", want)
+		}
+	}
+	for _, unwanted := range []string{`code="2330"`, "twse_index_value", "twse_cache_hits_total"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("probe has %s, want only stock metrics of the target", unwanted)
+		}
+	}
+
+	// The symbol counts stay those of exChList
+	if rec := scrape(metrics, "/metrics"); !strings.Contains(rec.Body.String(), "twse_symbols_requested 2\n") {
+		t.Errorf("/metrics has no twse_symbols_requested 2 after a probe")
+	}
+}
+
+func TestProbeHandlerBadTarget(t *testing.T) {
+	useUpstream(t, serveFile(t, testPayload), nil)
+	probe := probeHandler(stockMetrics, promhttp.HandlerOpts{})
+
+	for _, url := range []string{
+		"/probe",
+		"/probe?target=",
+		"/probe?target=2330",
+		"/probe?target=tse_2330",
+		"/probe?target=tse_23|30.tw",
+		"/probe?target=tse_2330.tw%7Cotc_6488.tw",
+	} {
+		if rec := scrape(probe, url); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", url, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/elleryq/twse_exporter/twse"
+)
+
+// symbolPrefixes are the exChList prefixes tried by the symbols
+// subcommand, with what they mean
+var symbolPrefixes = []struct{ ex, market string }{
+	{"tse", "listed (上市)"},
+	{"otc", "OTC (上櫃)"},
+}
+
+// symbolsFetcher returns the fetcher of the config of source, or of the
+// defaults when the config file does not exist, as the symbols subcommand
+// is meant to run before exChList is written
+func symbolsFetcher(source *configSource) (*twse.Fetcher, error) {
+	if source.content == "" {
+		if _, err := os.Stat(source.path); errors.Is(err, fs.ErrNotExist) {
+			return newFetcher(&Config{}), nil
+		}
+	}
+	config, err := source.load()
+	if err != nil {
+		return nil, err
+	}
+	return newFetcher(config), nil
+}
+
+// runSymbols looks codes up on TWSE under every symbolPrefixes and writes
+// the exChList symbol and name of each found, for the symbols subcommand.
+// It fails when a code is not found.
+func runSymbols(ctx context.Context, w io.Writer, f *twse.Fetcher, codes []string) error {
+	if len(codes) == 0 {
+		return errors.New("no code given, e.g. symbols 2330")
+	}
+
+	var missing []string
+	for _, code := range codes {
+		var list []string
+		for _, prefix := range symbolPrefixes {
+			symbol := prefix.ex + "_" + code + ".tw"
+			if !symbolPattern.MatchString(symbol) {
+				return fmt.Errorf("code %q is not alphanumeric", code)
+			}
+			list = append(list, symbol)
+		}
+
+		stockInfos, err := f.FetchStockInfo(ctx, list)
+		if err != nil && !errors.Is(err, twse.ErrEmptyResponse) {
+			return fmt.Errorf("failed to look up %s: %v", code, err)
+		}
+		found := false
+		for _, info := range stockInfos {
+			if !slices.Contains(list, twse.Symbol(info)) {
+				continue
+			}
+			found = true
+			market := info.Ex
+			for _, prefix := range symbolPrefixes {
+				if prefix.ex == info.Ex {
+					market = prefix.market
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", twse.Symbol(info), strings.TrimSpace(info.N), market)
+		}
+		if !found {
+			missing = append(missing, code)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("not found on TWSE: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
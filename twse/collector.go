@@ -0,0 +1,814 @@
+package twse
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"math/big"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stockLabels are attached to every per-stock series
+var stockLabels = []string{"exchange", "code", "suffix", "name", "market", "currency", "alias"}
+
+// exchangeMarkets maps the ex field of the equity exchanges to the market
+// and currency labels. Indices have no stock series but index_value, with
+// indexMarket, see indexNames, and other exchanges only quote_value.
+var exchangeMarkets = map[string]struct{ market, currency string }{
+	"tse": {"listed", "TWD"}, // 上市
+	"otc": {"otc", "TWD"},    // 上櫃
+}
+
+// indexMarket is the market and currency of the indices of indexNames
+var indexMarket = struct{ market, currency string }{"index", "TWD"}
+
+// StockMetricNames are the per-stock series as named after
+// <prefix>_stock_, selectable with Options.Metrics
+var StockMetricNames = []string{
+	"up", "price", "open", "high", "low", "prev_close", "reference_price",
+	"change", "change_percent", "baseline_price", "deviation_percent",
+	"volume", "tick_volume", "turnover", "quote_timestamp_seconds", "stale",
+	"bid_price", "bid_volume", "ask_price", "ask_volume", "bid_levels", "ask_levels",
+	"limit_up", "limit_down", "at_limit", "trading_state_info",
+}
+
+const (
+	DefaultLimitEpsilon   = 0.005
+	DefaultStaleThreshold = 5 * time.Minute
+)
+
+// Options are the settings of a Collector, which may be swapped while
+// it is in use with SetOptions
+type Options struct {
+	// LimitEpsilon is how close the price must be to a price limit to
+	// count as at the limit, absorbing float noise in the feed
+	LimitEpsilon float64
+	// StaleThreshold is the quote age after which a stock is stale
+	StaleThreshold time.Duration
+	// Include and Exclude are glob patterns matched against <ex>_<code>,
+	// an empty Include means all stocks. Exclude wins over Include.
+	Include []string
+	Exclude []string
+	// Metrics are the StockMetricNames to emit, nil means all
+	Metrics map[string]bool
+	// FailOnTotalOutage reports an invalid metric when no symbol has a
+	// price, failing the scrape with promhttp.HTTPErrorOnError
+	FailOnTotalOutage bool
+	// Symbols are the requested exChList entries, whose stock_up is
+	// reported even when TWSE dropped them
+	Symbols []string
+	// EmitZeroValues sends the series of fields that are 0, such as the
+	// volume early in the session. Fields without a value, e.g. "-", are
+	// never sent.
+	EmitZeroValues bool
+	// Aliases map symbols, e.g. tse_2330.tw, to the alias label of their
+	// series such as TSMC. Other stocks have an empty alias, which
+	// Prometheus treats as no label.
+	Aliases map[string]string
+	// Baselines map symbols to a reference price such as a 20-day
+	// average, exported with the deviation of the price from it
+	Baselines map[string]float64
+	// SampleTimestamps stamps the series of a symbol with its quote time
+	// tlong instead of leaving it to the scrape time
+	SampleTimestamps bool
+	// PriceDecimals rounds the price-like series half to even to that
+	// many decimals, negative for no rounding
+	PriceDecimals int
+	// InfoLabels are the InfoFields exported as labels of stock_info,
+	// none to not export it
+	InfoLabels []string
+	// MaxSeries caps the series of a scrape, 0 for no limit. Series past
+	// it are dropped and series_limit_exceeded is set.
+	MaxSeries int
+}
+
+// InfoFields are the raw StockInfo fields selectable as InfoLabels, by
+// their JSON name
+var InfoFields = []string{"n", "nf", "ex", "c", "ch"}
+
+// infoField returns the InfoFields value of info
+func infoField(info StockInfo, name string) string {
+	switch name {
+	case "n":
+		return info.N
+	case "nf":
+		return info.Nf
+	case "ex":
+		return info.Ex
+	case "c":
+		return info.C
+	case "ch":
+		return info.Ch
+	}
+	return ""
+}
+
+// DefaultOptions returns the Options of a new Collector
+func DefaultOptions() *Options {
+	return &Options{
+		LimitEpsilon:   DefaultLimitEpsilon,
+		StaleThreshold: DefaultStaleThreshold,
+		PriceDecimals:  noRounding,
+		EmitZeroValues: true,
+	}
+}
+
+// noRounding is the PriceDecimals that leaves values as is
+const noRounding = -1
+
+// emits reports whether the per-stock series name is enabled
+func (o *Options) emits(name string) bool {
+	return o.Metrics == nil || o.Metrics[name]
+}
+
+// emitsValue reports whether v of a TWSE field is sent, see EmitZeroValues
+func (o *Options) emitsValue(v float64) bool {
+	return v != 0 || o.EmitZeroValues
+}
+
+// wants reports whether the stock passes the include/exclude filters
+func (o *Options) wants(info StockInfo) bool {
+	symbol := info.Ex + "_" + info.C
+	for _, pattern := range o.Exclude {
+		if ok, _ := path.Match(pattern, symbol); ok {
+			return false
+		}
+	}
+	if len(o.Include) == 0 {
+		return true
+	}
+	for _, pattern := range o.Include {
+		if ok, _ := path.Match(pattern, symbol); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CachedStock is a stock with the time it was last fetched
+type CachedStock struct {
+	Info      StockInfo
+	FetchedAt time.Time
+}
+
+// Source returns the stocks to export on a scrape, together with the
+// time of the last successful fetch and the error of the last fetch. A
+// stock fetched before that time was missing from the last fetch.
+type Source func(ctx context.Context) ([]CachedStock, time.Time, error)
+
+// options holds the Options of a Collector, shared by its WithContext
+// copies
+type options struct {
+	mutex sync.RWMutex
+	opts  *Options
+	// info is the stock_info desc of opts.InfoLabels, nil without any
+	info *prometheus.Desc
+}
+
+// Collector emits metrics from the stocks of a Source on every scrape,
+// so gauges are not rebuilt per scrape.
+type Collector struct {
+	// ctx is passed to source, see WithContext
+	ctx     context.Context
+	source  Source
+	options *options
+	prefix  string
+	// symbols restricts the stocks to export, see WithSymbols
+	symbols []string
+
+	up         *prometheus.Desc
+	lastUpdate *prometheus.Desc
+	cacheAge   *prometheus.Desc
+	seriesCap  *prometheus.Desc
+
+	price         *prometheus.Desc
+	open          *prometheus.Desc
+	high          *prometheus.Desc
+	low           *prometheus.Desc
+	prevClose     *prometheus.Desc
+	refPrice      *prometheus.Desc
+	change        *prometheus.Desc
+	changePercent *prometheus.Desc
+	baseline      *prometheus.Desc
+	deviation     *prometheus.Desc
+	volume        *prometheus.Desc
+	tickVolume    *prometheus.Desc
+	turnover      *prometheus.Desc
+	quoteTime     *prometheus.Desc
+	stale         *prometheus.Desc
+	bidPrice      *prometheus.Desc
+	bidVolume     *prometheus.Desc
+	askPrice      *prometheus.Desc
+	askVolume     *prometheus.Desc
+	bidLevels     *prometheus.Desc
+	askLevels     *prometheus.Desc
+	limitUp       *prometheus.Desc
+	limitDown     *prometheus.Desc
+	atLimit       *prometheus.Desc
+	tradingState  *prometheus.Desc
+
+	stockUp    *prometheus.Desc
+	indexValue *prometheus.Desc
+	quoteValue *prometheus.Desc
+}
+
+// indexNames maps the codes of the market indices on MIS to the index
+// label, e.g. tse_t00.tw is TAIEX
+var indexNames = map[string]string{
+	"t00": "TAIEX", // 發行量加權股價指數
+	"o00": "TPEx",  // 櫃買指數
+}
+
+// HelpData is what the help template of NewCollector is executed with
+type HelpData struct {
+	// Name is the StockMetricNames entry, e.g. price
+	Name string
+	// Help is the default help text
+	Help string
+}
+
+// NewCollector returns a Collector of the stocks from source, as metrics
+// named with prefix, e.g. twse. The help of the per-stock series is
+// rendered by helpTemplate when not nil.
+func NewCollector(prefix string, helpTemplate *template.Template, source Source) *Collector {
+	stockDesc := func(name, help string, extraLabels ...string) *prometheus.Desc {
+		if helpTemplate != nil {
+			help = renderHelp(helpTemplate, HelpData{Name: strings.TrimPrefix(name, "stock_"), Help: help})
+		}
+		return prometheus.NewDesc(prefix+"_"+name, help, withLabels(stockLabels, extraLabels...), nil)
+	}
+
+	return &Collector{
+		source:  source,
+		options: &options{opts: DefaultOptions()},
+		prefix:  prefix,
+
+		up:         prometheus.NewDesc(prefix+"_up", "Whether the last fetch from TWSE succeeded", nil, nil),
+		lastUpdate: prometheus.NewDesc(prefix+"_last_update_timestamp_seconds", "Unix time of the last successful fetch from TWSE", nil, nil),
+		cacheAge:   prometheus.NewDesc(prefix+"_cache_age_seconds", "Seconds since the last successful fetch from TWSE, as of the scrape", nil, nil),
+		seriesCap:  prometheus.NewDesc(prefix+"_series_limit_exceeded", "Whether series were dropped for exceeding maxSeries", nil, nil),
+
+		price:         stockDesc("stock_price", "Last traded price, taken from pz, z or y in that order", "price_source"), // 即時成交價
+		open:          stockDesc("stock_open", "Opening price"),                                                           // 開盤價
+		high:          stockDesc("stock_high", "Day high price"),                                                          // 最高價
+		low:           stockDesc("stock_low", "Day low price"),                                                            // 最低價
+		prevClose:     stockDesc("stock_prev_close", "Previous close price"),                                              // 昨收價
+		refPrice:      stockDesc("stock_reference_price", "Reference price, the base of the price limits"),                // 參考價
+		change:        stockDesc("stock_change", "Change of the price against the previous close"),                        // 漲跌
+		changePercent: stockDesc("stock_change_percent", "Change of the price against the previous close (%)"),            // 漲跌幅
+		baseline:      stockDesc("stock_baseline_price", "Baseline price from baselineFile"),
+		deviation:     stockDesc("stock_deviation_percent", "Deviation of the price from the baseline price (%)"),
+		volume:        stockDesc("stock_volume", "Accumulated volume of the day in lots"),                                                         // 累積成交量
+		tickVolume:    stockDesc("stock_tick_volume", "Volume of the last trade in lots"),                                                         // 當盤成交量
+		turnover:      stockDesc("stock_turnover", "Estimated turnover in thousands of TWD, the price times the volume, not the official figure"), // 成交金額
+		quoteTime:     stockDesc("stock_quote_timestamp_seconds", "Unix time of the quote"),                                                       // 報價時間
+		stale:         stockDesc("stock_stale", "1 if the quote is older than staleThreshold"),
+		bidPrice:      stockDesc("stock_bid_price", "Best five bid prices", "level"),           // 最佳五檔買進價
+		bidVolume:     stockDesc("stock_bid_volume", "Best five bid volumes in lots", "level"), // 最佳五檔買進量
+		askPrice:      stockDesc("stock_ask_price", "Best five ask prices", "level"),           // 最佳五檔賣出價
+		askVolume:     stockDesc("stock_ask_volume", "Best five ask volumes in lots", "level"), // 最佳五檔賣出量
+		bidLevels:     stockDesc("stock_bid_levels", "Number of quoted bid levels, at most five"),
+		askLevels:     stockDesc("stock_ask_levels", "Number of quoted ask levels, at most five"),
+		limitUp:       stockDesc("stock_limit_up", "Limit up price"),     // 漲停價
+		limitDown:     stockDesc("stock_limit_down", "Limit down price"), // 跌停價
+		atLimit:       stockDesc("stock_at_limit", "1 at limit up, -1 at limit down, 0 otherwise"),
+		tradingState:  stockDesc("stock_trading_state_info", "Raw undocumented state flags ip and ts from TWSE, always 1", "ip", "ts"),
+
+		stockUp:    prometheus.NewDesc(prefix+"_stock_up", "1 if the configured symbol was received with a price in the last fetch", []string{"exchange", "code"}, nil),
+		indexValue: prometheus.NewDesc(prefix+"_index_value", "Value of a market index", []string{"index", "market", "currency"}, nil), // 大盤指數
+		quoteValue: prometheus.NewDesc(prefix+"_quote_value", "Last price of a symbol outside the tse and otc exchanges", []string{"symbol", "exchange", "code", "name"}, nil),
+	}
+}
+
+// WithContext returns a copy of c whose Collect calls the source with
+// ctx, e.g. the request context of a scrape. The copy shares the
+// Options of c.
+func (c *Collector) WithContext(ctx context.Context) *Collector {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// WithSymbols returns a copy of c exporting only the symbols, e.g.
+// tse_2330.tw, which also replace Options.Symbols for stock_up. The copy
+// shares the Options of c.
+func (c *Collector) WithSymbols(symbols []string) *Collector {
+	c2 := *c
+	c2.symbols = symbols
+	return &c2
+}
+
+// WithSource returns a copy of c collecting from source, e.g. a live fetch
+// of a single symbol. The copy shares the Options of c.
+func (c *Collector) WithSource(source Source) *Collector {
+	c2 := *c
+	c2.source = source
+	return &c2
+}
+
+// SetOptions swaps the Options in effect, opts must not be changed
+// afterwards. A change of InfoLabels changes what Describe sends, so c
+// must be registered anew, e.g. per scrape.
+func (c *Collector) SetOptions(opts *Options) {
+	var info *prometheus.Desc
+	if len(opts.InfoLabels) > 0 {
+		info = prometheus.NewDesc(c.prefix+"_stock_info", "Raw fields from TWSE selected by infoLabels, always 1", withLabels(stockLabels, opts.InfoLabels...), nil)
+	}
+
+	c.options.mutex.Lock()
+	defer c.options.mutex.Unlock()
+
+	c.options.opts = opts
+	c.options.info = info
+}
+
+// Options returns the Options in effect
+func (c *Collector) Options() *Options {
+	opts, _ := c.current()
+	return opts
+}
+
+// current returns the Options in effect and their stock_info desc
+func (c *Collector) current() (*Options, *prometheus.Desc) {
+	c.options.mutex.RLock()
+	defer c.options.mutex.RUnlock()
+
+	return c.options.opts, c.options.info
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.up, c.lastUpdate, c.cacheAge, c.seriesCap,
+		c.price, c.open, c.high, c.low, c.prevClose, c.refPrice, c.change, c.changePercent, c.baseline, c.deviation,
+		c.volume, c.tickVolume, c.turnover, c.quoteTime, c.stale,
+		c.bidPrice, c.bidVolume, c.askPrice, c.askVolume, c.bidLevels, c.askLevels,
+		c.limitUp, c.limitDown, c.atLimit, c.tradingState,
+		c.stockUp, c.indexValue, c.quoteValue,
+	} {
+		ch <- desc
+	}
+	if _, info := c.current(); info != nil {
+		ch <- info
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	opts, info := c.current()
+	if opts.MaxSeries <= 0 {
+		c.collect(func(m prometheus.Metric) { ch <- m }, opts, info)
+		return
+	}
+
+	// Series past MaxSeries are dropped
+	var sent, dropped int
+	c.collect(func(m prometheus.Metric) {
+		if sent >= opts.MaxSeries {
+			dropped++
+			return
+		}
+		sent++
+		ch <- m
+	}, opts, info)
+	exceeded := 0.0
+	if dropped > 0 {
+		slog.Warn("Dropped series over maxSeries", "max_series", opts.MaxSeries, "dropped", dropped)
+		exceeded = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.seriesCap, prometheus.GaugeValue, exceeded)
+}
+
+// collect sends the series of Collect
+func (c *Collector) collect(send func(prometheus.Metric), opts *Options, info *prometheus.Desc) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// twse_up is always served so upstream failures can be alerted on
+	stocks, fetchedAt, err := c.source(ctx)
+	if !fetchedAt.IsZero() {
+		send(prometheus.MustNewConstMetric(c.lastUpdate, prometheus.GaugeValue, float64(fetchedAt.UnixNano())/1e9))
+		// Unlike time() - last_update it needs no clock in sync with Prometheus
+		send(prometheus.MustNewConstMetric(c.cacheAge, prometheus.GaugeValue, time.Since(fetchedAt).Seconds()))
+	}
+	up := 1.0
+	if err != nil {
+		slog.Error("Failed to fetch stock info", "err", err)
+		up = 0
+	}
+	send(prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up))
+
+	received := make(map[string]bool)
+	symbols := opts.Symbols
+	if c.symbols != nil {
+		symbols = c.symbols
+	}
+	for _, stock := range stocks {
+		if !opts.wants(stock.Info) || (c.symbols != nil && !slices.Contains(c.symbols, Symbol(stock.Info))) {
+			continue
+		}
+		// Stocks missing from the last fetch serve their last-known value
+		refreshed := !stock.FetchedAt.Before(fetchedAt)
+		stockSend := send
+		if t, ok := quoteTime(stock.Info); ok && opts.SampleTimestamps {
+			stockSend = func(m prometheus.Metric) { send(prometheus.NewMetricWithTimestamp(t, m)) }
+		}
+		var hasPrice bool
+		if index, ok := indexNames[stock.Info.C]; ok {
+			hasPrice = c.collectIndex(stockSend, stock.Info, index, opts)
+		} else if _, ok := exchangeMarkets[stock.Info.Ex]; !ok {
+			hasPrice = c.collectQuote(stockSend, stock.Info, opts)
+		} else {
+			hasPrice = c.collectStock(stockSend, stock.Info, refreshed, opts)
+			if info != nil {
+				collectInfo(stockSend, info, stock.Info, opts)
+			}
+		}
+		if hasPrice && refreshed {
+			received[Symbol(stock.Info)] = true
+		}
+	}
+	if opts.FailOnTotalOutage && len(received) == 0 {
+		send(prometheus.NewInvalidMetric(c.up, errors.New("no symbol with a price received from TWSE")))
+	}
+
+	// Configured symbols are reported even when TWSE dropped them, once
+	// each however often they are listed
+	if opts.emits("up") {
+		reported := make(map[string]bool)
+		for _, symbol := range symbols {
+			ex, code := SplitSymbol(symbol)
+			if _, ok := indexNames[code]; ok || reported[symbol] || !opts.wants(StockInfo{Ex: ex, C: code}) {
+				continue
+			}
+			reported[symbol] = true
+			var stockUp float64
+			if received[symbol] {
+				stockUp = 1
+			}
+			send(prometheus.MustNewConstMetric(c.stockUp, prometheus.GaugeValue, stockUp, sanitizeLabelValue(ex), sanitizeLabelValue(code)))
+		}
+	}
+}
+
+// renderHelp executes t with data, falling back to the default help on
+// error. Callers should run t against every metric up front.
+func renderHelp(t *template.Template, data HelpData) string {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		slog.Warn("Failed to render help, using the default", "metric", data.Name, "err", err)
+		return data.Help
+	}
+	return b.String()
+}
+
+// collectStock sends the metrics of a single stock and reports whether
+// it has a price
+func (c *Collector) collectStock(send func(prometheus.Metric), info StockInfo, refreshed bool, opts *Options) bool {
+	labels := stockLabelValues(info, opts)
+	symbol := info.Ex + "_" + info.C
+
+	// Price, TWSE sends "-" when there is no trade yet
+	price, source, hasPrice := stockPrice(info)
+	if !hasPrice {
+		slog.Debug("Skip price: no value", "symbol", symbol)
+	} else if opts.emits("price") && opts.emitsValue(price) {
+		send(prometheus.MustNewConstMetric(c.price, prometheus.GaugeValue, roundHalfEven(price, opts.PriceDecimals), withLabels(labels, source)...))
+	}
+	// The previous close y stands in for the price before the first
+	// trade, the series derived from the price would report a trade that
+	// did not happen
+	traded := hasPrice && source != "y"
+
+	// Opening price, TWSE sends "-" before market open
+	if opts.emits("open") && !collectField(send, symbol, c.open, labels, info.O, opts, true) {
+		slog.Warn("Skip opening price: no value", "symbol", symbol)
+	}
+
+	// Day high and low, omitted before market open
+	if opts.emits("high") {
+		collectField(send, symbol, c.high, labels, info.H, opts, true)
+	}
+	if opts.emits("low") {
+		collectField(send, symbol, c.low, labels, info.L, opts, true)
+	}
+
+	// Previous close, used for change calculations
+	prevClose, hasPrevClose := parsePrice(symbol, info.Y)
+	if !hasPrevClose {
+		slog.Debug("Skip previous close: no value", "symbol", symbol)
+	} else if opts.emits("prev_close") && opts.emitsValue(prevClose) {
+		send(prometheus.MustNewConstMetric(c.prevClose, prometheus.GaugeValue, roundHalfEven(prevClose, opts.PriceDecimals), labels...))
+	}
+
+	// Reference price p, the base of the price limits. It usually equals
+	// the previous close, but differs e.g. after an ex-dividend date.
+	// Unlike the opening price o it is known before the first trade.
+	if refPrice, ok := parsePrice(symbol, info.P); ok && refPrice != 0 && opts.emits("reference_price") {
+		send(prometheus.MustNewConstMetric(c.refPrice, prometheus.GaugeValue, roundHalfEven(refPrice, opts.PriceDecimals), labels...))
+	}
+
+	// Change against previous close, percent rounded to 2 decimals
+	// as shown on the TWSE site
+	if traded && hasPrevClose && prevClose != 0 {
+		change := price - prevClose
+		if opts.emits("change") {
+			send(prometheus.MustNewConstMetric(c.change, prometheus.GaugeValue, roundHalfEven(change, opts.PriceDecimals), labels...))
+		}
+		if opts.emits("change_percent") {
+			send(prometheus.MustNewConstMetric(c.changePercent, prometheus.GaugeValue, math.Round(change/prevClose*10000)/100, labels...))
+		}
+	}
+
+	// Deviation from an external baseline, omitted for stocks without one
+	if baseline, ok := opts.Baselines[Symbol(info)]; ok {
+		if opts.emits("baseline_price") {
+			send(prometheus.MustNewConstMetric(c.baseline, prometheus.GaugeValue, roundHalfEven(baseline, opts.PriceDecimals), labels...))
+		}
+		if traded && baseline != 0 && opts.emits("deviation_percent") {
+			send(prometheus.MustNewConstMetric(c.deviation, prometheus.GaugeValue, math.Round((price-baseline)/baseline*10000)/100, labels...))
+		}
+	}
+
+	// Accumulated and tick volume, 0 is a valid value early in the session
+	volume, hasVolume := parsePrice(symbol, info.V)
+	if hasVolume && opts.emits("volume") && opts.emitsValue(volume) {
+		send(prometheus.MustNewConstMetric(c.volume, prometheus.GaugeValue, volume, labels...))
+	}
+	if opts.emits("tick_volume") {
+		collectField(send, symbol, c.tickVolume, labels, info.Tv, opts, false)
+	}
+
+	// MIS has no turnover field, approximate it by the current price
+	// times the volume in lots (張), i.e. in thousands of TWD. It ignores
+	// the intraday price path, so it drifts from the official figure.
+	if hasVolume && traded && opts.emits("turnover") {
+		send(prometheus.MustNewConstMetric(c.turnover, prometheus.GaugeValue, price*volume, labels...))
+	}
+
+	// Quote time in epoch milliseconds, to spot frozen symbols. A quote
+	// without time, or not refreshed by the last fetch, counts as stale.
+	stale := 1.0
+	if info.Tlong == "" {
+		slog.Debug("No quote time, flagged stale", "symbol", symbol)
+	} else if tlong, err := strconv.ParseInt(info.Tlong, 10, 64); err != nil {
+		slog.Warn("Failed to parse quote time, flagged stale", "symbol", symbol, "err", err)
+		parseErrors.WithLabelValues(symbol).Inc()
+	} else {
+		if opts.emits("quote_timestamp_seconds") {
+			send(prometheus.MustNewConstMetric(c.quoteTime, prometheus.GaugeValue, float64(tlong)/1000, labels...))
+		}
+		if refreshed && time.Since(time.UnixMilli(tlong)) <= opts.StaleThreshold {
+			stale = 0
+		}
+	}
+	if opts.emits("stale") {
+		send(prometheus.MustNewConstMetric(c.stale, prometheus.GaugeValue, stale, labels...))
+	}
+
+	// Daily upper (漲停) and lower (跌停) price limits
+	limitUp, hasLimitUp := parsePrice(symbol, info.U)
+	if hasLimitUp && opts.emits("limit_up") && opts.emitsValue(limitUp) {
+		send(prometheus.MustNewConstMetric(c.limitUp, prometheus.GaugeValue, roundHalfEven(limitUp, opts.PriceDecimals), labels...))
+	}
+	limitDown, hasLimitDown := parsePrice(symbol, info.W)
+	if hasLimitDown && opts.emits("limit_down") && opts.emitsValue(limitDown) {
+		send(prometheus.MustNewConstMetric(c.limitDown, prometheus.GaugeValue, roundHalfEven(limitDown, opts.PriceDecimals), labels...))
+	}
+	if traded && (hasLimitUp || hasLimitDown) && opts.emits("at_limit") {
+		var atLimit float64
+		if hasLimitUp && math.Abs(price-limitUp) <= opts.LimitEpsilon {
+			atLimit = 1
+		} else if hasLimitDown && math.Abs(price-limitDown) <= opts.LimitEpsilon {
+			atLimit = -1
+		}
+		send(prometheus.MustNewConstMetric(c.atLimit, prometheus.GaugeValue, atLimit, labels...))
+	}
+
+	// TWSE does not document ip and ts, they are commonly read as a
+	// trend/halt flag and a trial matching flag. Pass them through as is
+	// rather than guess an enum.
+	if (info.Ip != "" || info.Ts != "") && opts.emits("trading_state_info") {
+		send(prometheus.MustNewConstMetric(c.tradingState, prometheus.GaugeValue, 1, withLabels(labels, sanitizeLabelValue(info.Ip), sanitizeLabelValue(info.Ts))...))
+	}
+
+	// Five levels of bid/ask prices and volumes
+	if opts.emits("bid_price") {
+		collectLadder(send, symbol, c.bidPrice, labels, info.B, opts, true)
+	}
+	if opts.emits("bid_volume") {
+		collectLadder(send, symbol, c.bidVolume, labels, info.G, opts, false)
+	}
+	if opts.emits("ask_price") {
+		collectLadder(send, symbol, c.askPrice, labels, info.A, opts, true)
+	}
+	if opts.emits("ask_volume") {
+		collectLadder(send, symbol, c.askVolume, labels, info.F, opts, false)
+	}
+
+	// Number of quoted levels, fewer than five on a thin order book
+	if opts.emits("bid_levels") {
+		send(prometheus.MustNewConstMetric(c.bidLevels, prometheus.GaugeValue, float64(ladderLevels(info.B)), labels...))
+	}
+	if opts.emits("ask_levels") {
+		send(prometheus.MustNewConstMetric(c.askLevels, prometheus.GaugeValue, float64(ladderLevels(info.A)), labels...))
+	}
+
+	return hasPrice
+}
+
+// quoteTime returns the quote time tlong of info, false without one
+func quoteTime(info StockInfo) (time.Time, bool) {
+	tlong, err := strconv.ParseInt(info.Tlong, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(tlong), true
+}
+
+// collectInfo sends the stock_info series of info with the fields as
+// extra labels
+func collectInfo(send func(prometheus.Metric), desc *prometheus.Desc, info StockInfo, opts *Options) {
+	labels := stockLabelValues(info, opts)
+	for _, field := range opts.InfoLabels {
+		labels = append(labels, sanitizeLabelValue(strings.TrimSpace(infoField(info, field))))
+	}
+	send(prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, labels...))
+}
+
+// collectIndex sends the value of a market index, which has no stock
+// fields such as volume or bid/ask, and reports whether it has a value
+func (c *Collector) collectIndex(send func(prometheus.Metric), info StockInfo, index string, opts *Options) bool {
+	value, _, ok := stockPrice(info)
+	if !ok {
+		slog.Debug("Skip index: no value", "symbol", info.Ex+"_"+info.C)
+		return false
+	}
+	send(prometheus.MustNewConstMetric(c.indexValue, prometheus.GaugeValue, roundHalfEven(value, opts.PriceDecimals), index, indexMarket.market, indexMarket.currency))
+	return true
+}
+
+// collectQuote sends the price of a symbol of an exchange other than tse
+// and otc. Its fields are not known to follow those of stocks, so only
+// the price is exported, and reports whether it has one.
+func (c *Collector) collectQuote(send func(prometheus.Metric), info StockInfo, opts *Options) bool {
+	value, _, ok := stockPrice(info)
+	if !ok {
+		slog.Debug("Skip quote: no value", "symbol", info.Ex+"_"+info.C)
+		return false
+	}
+	code, _ := SplitCh(info)
+	send(prometheus.MustNewConstMetric(c.quoteValue, prometheus.GaugeValue, roundHalfEven(value, opts.PriceDecimals),
+		sanitizeLabelValue(Symbol(info)), sanitizeLabelValue(info.Ex), sanitizeLabelValue(code), sanitizeLabelValue(stockName(info))))
+	return true
+}
+
+// stockLabelValues returns the stockLabels values of info. Metric names
+// are fixed, but label values still come from TWSE and invalid UTF-8
+// would make MustNewConstMetric panic, so invalid runes are replaced by "_".
+func stockLabelValues(info StockInfo, opts *Options) []string {
+	m := exchangeMarkets[info.Ex]
+	code, suffix := SplitCh(info)
+	return []string{
+		sanitizeLabelValue(info.Ex),
+		sanitizeLabelValue(code),
+		sanitizeLabelValue(suffix),
+		sanitizeLabelValue(stockName(info)),
+		m.market,
+		m.currency,
+		opts.Aliases[Symbol(info)],
+	}
+}
+
+// stockName returns the short company name n, falling back to the full
+// name nf
+func stockName(info StockInfo) string {
+	if name := strings.TrimSpace(info.N); name != "" {
+		return name
+	}
+	return strings.TrimSpace(info.Nf)
+}
+
+// withLabels returns a copy of labels with extra appended
+func withLabels(labels []string, extra ...string) []string {
+	return append(append([]string{}, labels...), extra...)
+}
+
+// sanitizeLabelValue replaces invalid UTF-8 in s with "_"
+func sanitizeLabelValue(s string) string {
+	return strings.ToValidUTF8(s, "_")
+}
+
+// stockPrice returns the price of info and the field it came from. It
+// falls back from pz to the last trade price z, then to the previous
+// close y, so the price series stays continuous across sessions.
+func stockPrice(info StockInfo) (float64, string, bool) {
+	for _, field := range []struct{ source, value string }{
+		{"pz", info.Pz},
+		{"z", info.Z},
+		{"y", info.Y},
+	} {
+		if v, ok := parsePrice(info.Ex+"_"+info.C, field.value); ok {
+			return v, field.source, true
+		}
+	}
+
+	return 0, "", false
+}
+
+// parsePrice parses a numeric TWSE field. It returns false when the
+// field has no value, i.e. "", "-" or whitespace, or is not a number.
+// Thousands separators such as in "1,234,567" are ignored.
+func parsePrice(symbol, s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-" {
+		return 0, false
+	}
+	s = strings.NewReplacer(",", "", " ", "").Replace(s)
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		slog.Warn("Failed to parse numeric field", "symbol", symbol, "value", s, "err", err)
+		parseErrors.WithLabelValues(symbol).Inc()
+		return 0, false
+	}
+
+	return v, true
+}
+
+// collectField parses value and sends it as a gauge of desc, rounded by
+// PriceDecimals when it is a price. It returns false, sending nothing,
+// when value has no value. A 0 omitted by EmitZeroValues has a value.
+func collectField(send func(prometheus.Metric), symbol string, desc *prometheus.Desc, labels []string, value string, opts *Options, price bool) bool {
+	v, ok := parsePrice(symbol, value)
+	if !ok {
+		return false
+	}
+	if !opts.emitsValue(v) {
+		return true
+	}
+	decimals := noRounding
+	if price {
+		decimals = opts.PriceDecimals
+	}
+	send(prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, roundHalfEven(v, decimals), labels...))
+
+	return true
+}
+
+// collectLadder sends one series per level of a "_" separated bid/ask
+// ladder. TWSE pads the ladder with a trailing "_", empty segments are
+// skipped.
+func collectLadder(send func(prometheus.Metric), symbol string, desc *prometheus.Desc, labels []string, ladder string, opts *Options, price bool) {
+	for i, segment := range strings.Split(ladder, "_") {
+		collectField(send, symbol, desc, withLabels(labels, strconv.Itoa(i+1)), segment, opts, price)
+	}
+}
+
+// roundHalfEven rounds v half to even to decimals, negative for none.
+// It rounds the shortest decimal form of v, so 1.005 is a tie as it reads
+// rather than the 1.00499... it is stored as.
+func roundHalfEven(v float64, decimals int) float64 {
+	if decimals < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(v, 'f', -1, 64))
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	r.Mul(r, new(big.Rat).SetInt(scale))
+
+	// Split into a floor and a remainder in [0, 1)
+	q, m := new(big.Int).DivMod(r.Num(), r.Denom(), new(big.Int))
+	switch new(big.Int).Lsh(m, 1).Cmp(r.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(1))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	rounded, _ := new(big.Rat).SetFrac(q, scale).Float64()
+	return rounded
+}
+
+// ladderLevels counts the levels of a "_" separated ladder, skipping the
+// empty segment after the trailing "_" and "-" placeholders
+func ladderLevels(ladder string) int {
+	var levels int
+	for _, segment := range strings.Split(ladder, "_") {
+		if segment = strings.TrimSpace(segment); segment != "" && segment != "-" {
+			levels++
+		}
+	}
+	return levels
+}
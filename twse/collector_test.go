@@ -0,0 +1,561 @@
+package twse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// sample is a gathered series
+type sample struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// staticSource returns a Source of stocks, all fetched now
+func staticSource(stocks ...StockInfo) Source {
+	return func(ctx context.Context) ([]CachedStock, time.Time, error) {
+		now := time.Now()
+		var cached []CachedStock
+		for _, info := range stocks {
+			cached = append(cached, CachedStock{Info: info, FetchedAt: now})
+		}
+		return cached, now, nil
+	}
+}
+
+// newTestCollector returns a Collector of the stocks with opts, nil for
+// the defaults
+func newTestCollector(opts *Options, stocks ...StockInfo) *Collector {
+	c := NewCollector("twse", nil, staticSource(stocks...))
+	if opts != nil {
+		c.SetOptions(opts)
+	}
+	return c
+}
+
+// gather collects c by metric name, gauges and counters
+func gather(t *testing.T, c prometheus.Collector) map[string][]sample {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	samples := make(map[string][]sample)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			s := sample{labels: make(map[string]string), value: m.GetGauge().GetValue(), timestamp: m.GetTimestampMs()}
+			if m.GetCounter() != nil {
+				s.value = m.GetCounter().GetValue()
+			}
+			for _, pair := range m.GetLabel() {
+				s.labels[pair.GetName()] = pair.GetValue()
+			}
+			samples[family.GetName()] = append(samples[family.GetName()], s)
+		}
+	}
+	return samples
+}
+
+// find returns the sample of name whose labels include those given as
+// name/value pairs
+func find(samples map[string][]sample, name string, labels ...string) (sample, bool) {
+next:
+	for _, s := range samples[name] {
+		for i := 0; i+1 < len(labels); i += 2 {
+			if s.labels[labels[i]] != labels[i+1] {
+				continue next
+			}
+		}
+		return s, true
+	}
+	return sample{}, false
+}
+
+func TestMarketLabels(t *testing.T) {
+	samples := gather(t, newTestCollector(nil, loadPayload(t)...))
+
+	for _, tt := range []struct{ code, market, currency string }{
+		{"2330", "listed", "TWD"},
+		{"6488", "otc", "TWD"},
+	} {
+		s, ok := find(samples, "twse_stock_prev_close", "code", tt.code)
+		if !ok {
+			t.Errorf("no stock_prev_close of %s", tt.code)
+			continue
+		}
+		if s.labels["market"] != tt.market || s.labels["currency"] != tt.currency {
+			t.Errorf("%s: market %q, currency %q, want %q, %q", tt.code, s.labels["market"], s.labels["currency"], tt.market, tt.currency)
+		}
+	}
+
+	s, ok := find(samples, "twse_index_value", "index", "TAIEX")
+	if !ok {
+		t.Fatal("no index_value of TAIEX")
+	}
+	if s.labels["market"] != "index" || s.labels["currency"] != "TWD" {
+		t.Errorf("TAIEX: market %q, currency %q, want index, TWD", s.labels["market"], s.labels["currency"])
+	}
+	if s.value != 17853.76 {
+		t.Errorf("TAIEX = %v, want 17853.76", s.value)
+	}
+}
+
+func TestMixedExchanges(t *testing.T) {
+	f := newTestFetcher(t, serveStocks(loadPayload(t), nil))
+	symbols := []string{"tse_2330.tw", "otc_6488.tw"}
+	stocks, err := f.FetchStockInfo(context.Background(), symbols)
+	if err != nil {
+		t.Fatalf("FetchStockInfo() error = %v", err)
+	}
+	samples := gather(t, newTestCollector(&Options{Symbols: symbols, PriceDecimals: noRounding, EmitZeroValues: true}, stocks...))
+
+	for _, tt := range []struct {
+		exchange, code string
+		price, volume  float64
+	}{
+		{"tse", "2330", 593, 21917},
+		// No trade in z, the price falls back to the previous close
+		{"otc", "6488", 411.5, 1265},
+	} {
+		if s, ok := find(samples, "twse_stock_up", "exchange", tt.exchange, "code", tt.code); !ok || s.value != 1 {
+			t.Errorf("stock_up of %s_%s = %v, %v, want 1", tt.exchange, tt.code, s.value, ok)
+		}
+		if s, ok := find(samples, "twse_stock_price", "exchange", tt.exchange, "code", tt.code); !ok || s.value != tt.price {
+			t.Errorf("stock_price of %s_%s = %v, %v, want %v", tt.exchange, tt.code, s.value, ok, tt.price)
+		}
+		if s, ok := find(samples, "twse_stock_volume", "exchange", tt.exchange, "code", tt.code); !ok || s.value != tt.volume {
+			t.Errorf("stock_volume of %s_%s = %v, %v, want %v", tt.exchange, tt.code, s.value, ok, tt.volume)
+		}
+	}
+}
+
+func TestEdgeCaseCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		info       StockInfo
+		metric     string
+		wantLabels map[string]string
+	}{
+		{
+			name:       "leading digit",
+			info:       StockInfo{Ex: "tse", C: "00632R", Ch: "00632R.tw", Z: "10.0000"},
+			metric:     "twse_stock_price",
+			wantLabels: map[string]string{"code": "00632R", "suffix": "tw"},
+		},
+		{
+			name:       "punctuation",
+			info:       StockInfo{Ex: "tse", C: "2330-A:B", Ch: "2330-A:B.tw", Z: "10.0000"},
+			metric:     "twse_stock_price",
+			wantLabels: map[string]string{"code": "2330-A:B"},
+		},
+		{
+			name:       "no ch",
+			info:       StockInfo{Ex: "otc", C: "6488", Z: "10.0000"},
+			metric:     "twse_stock_price",
+			wantLabels: map[string]string{"code": "6488", "suffix": ""},
+		},
+		{
+			name:       "invalid UTF-8",
+			info:       StockInfo{Ex: "tse", C: "23\xff30", Ch: "23\xff30.tw", N: "台\xfe積電", Z: "10.0000"},
+			metric:     "twse_stock_price",
+			wantLabels: map[string]string{"code": "23_30", "name": "台_積電"},
+		},
+		{
+			name:       "other exchange",
+			info:       StockInfo{Ex: "x y", C: "a/b", Ch: "a/b.us", Z: "10.0000"},
+			metric:     "twse_quote_value",
+			wantLabels: map[string]string{"symbol": "x y_a/b.us", "code": "a/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The pedantic registry of gather fails on invalid series
+			samples := gather(t, newTestCollector(nil, tt.info))
+			if len(samples[tt.metric]) != 1 {
+				t.Fatalf("got %d %s series, want 1", len(samples[tt.metric]), tt.metric)
+			}
+			s := samples[tt.metric][0]
+			for name, want := range tt.wantLabels {
+				if got := s.labels[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		s      string
+		want   float64
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"-", 0, false},
+		{" ", 0, false},
+		{"\t\n", 0, false},
+		{" - ", 0, false},
+		{"abc", 0, false},
+		{"593.0000", 593, true},
+		{" 593.5 ", 593.5, true},
+		{"0", 0, true},
+		{"1234.56", 1234.56, true},
+		{"1,234.56", 1234.56, true},
+		{"1,234,567", 1234567, true},
+		{"1 234 567", 1234567, true},
+		{",", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parsePrice("tse_2330", tt.s)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parsePrice(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestNoValueFields(t *testing.T) {
+	info := StockInfo{Ex: "tse", C: "2330", Ch: "2330.tw", Z: "593.0000", Y: "-", O: "-", H: "", L: " ", U: "-", W: "-", V: "-"}
+	samples := gather(t, newTestCollector(nil, info))
+
+	if _, ok := find(samples, "twse_stock_price"); !ok {
+		t.Error("no stock_price")
+	}
+	// Fields without a value are skipped rather than failing the scrape
+	for _, name := range []string{"prev_close", "open", "high", "low", "limit_up", "limit_down", "volume", "change", "at_limit"} {
+		if _, ok := find(samples, "twse_stock_"+name); ok {
+			t.Errorf("got stock_%s of a field without a value", name)
+		}
+	}
+}
+
+func TestNameLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		info StockInfo
+		want string
+	}{
+		{"short name", StockInfo{N: " 台積電 ", Nf: "台灣積體電路製造股份有限公司"}, "台積電"},
+		{"full name", StockInfo{N: " ", Nf: "環球晶圓股份有限公司 "}, "環球晶圓股份有限公司"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.info.Ex, tt.info.C, tt.info.Ch, tt.info.Z = "tse", "2330", "2330.tw", "593.0000"
+			registry := prometheus.NewPedanticRegistry()
+			registry.MustRegister(newTestCollector(nil, tt.info))
+			rec := httptest.NewRecorder()
+			promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			// UTF-8 label values are exposed as is
+			if want := `name="` + tt.want + `"`; !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("no %s in:\n%s", want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestIncludeExclude(t *testing.T) {
+	tests := []struct {
+		name             string
+		include, exclude []string
+		// want are the codes exported, in the sorted order of Gather
+		want []string
+	}{
+		{"all", nil, nil, []string{"2317", "2330", "6488"}},
+		{"include", []string{"tse_*"}, nil, []string{"2317", "2330"}},
+		{"exclude", nil, []string{"otc_*"}, []string{"2317", "2330"}},
+		{"exclude wins", []string{"tse_23*"}, []string{"tse_2317"}, []string{"2330"}},
+		{"same pattern", []string{"tse_*"}, []string{"tse_*"}, nil},
+		{"several includes", []string{"tse_2330", "otc_*"}, []string{"tse_2*"}, []string{"6488"}},
+	}
+	stocks := []StockInfo{
+		{Ex: "tse", C: "2330", Ch: "2330.tw", Z: "593.0000"},
+		{Ex: "tse", C: "2317", Ch: "2317.tw", Z: "104.0000"},
+		{Ex: "otc", C: "6488", Ch: "6488.tw", Z: "411.5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Include, opts.Exclude = tt.include, tt.exclude
+			samples := gather(t, newTestCollector(opts, stocks...))
+			var got []string
+			for _, s := range samples["twse_stock_price"] {
+				got = append(got, s.labels["code"])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("exported %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnparseableRows(t *testing.T) {
+	// Counters are global, only their increase is of this test
+	parsed := func(symbol string) float64 {
+		s, _ := find(gather(t, parseErrors), "parse_errors_total", "symbol", symbol)
+		return s.value
+	}
+	before := parsed("tse_2317")
+
+	samples := gather(t, newTestCollector(nil,
+		StockInfo{Ex: "tse", C: "2330", Ch: "2330.tw", Z: "593.0000", V: "21917"},
+		StockInfo{Ex: "tse", C: "2317", Ch: "2317.tw", Z: "abc", Y: "1O4.5", V: "12x", Tlong: "soon"},
+		StockInfo{Ex: "otc", C: "6488", Ch: "6488.tw", Z: "411.5000", V: "bad"},
+	))
+
+	for _, code := range []string{"2330", "6488"} {
+		if _, ok := find(samples, "twse_stock_price", "code", code); !ok {
+			t.Errorf("no stock_price of %s next to unparseable rows", code)
+		}
+	}
+	if _, ok := find(samples, "twse_stock_volume", "code", "2330"); !ok {
+		t.Error("no stock_volume of 2330")
+	}
+	for _, name := range []string{"price", "volume", "quote_timestamp_seconds"} {
+		if _, ok := find(samples, "twse_stock_"+name, "code", "2317"); ok {
+			t.Errorf("got stock_%s of an unparseable field", name)
+		}
+	}
+	// Stale is still reported for a quote time that does not parse
+	if s, ok := find(samples, "twse_stock_stale", "code", "2317"); !ok || s.value != 1 {
+		t.Errorf("stock_stale of 2317 = %v, %v, want 1", s.value, ok)
+	}
+	// z and y for the price, y for the previous close, v and tlong
+	if got := parsed("tse_2317") - before; got != 5 {
+		t.Errorf("parse_errors_total of tse_2317 increased by %v, want 5", got)
+	}
+}
+
+func TestThousandsSeparators(t *testing.T) {
+	samples := gather(t, newTestCollector(nil, StockInfo{Ex: "tse", C: "2330", Ch: "2330.tw", Z: "1,234.56", V: "1,234,567"}))
+
+	for _, tt := range []struct {
+		name string
+		want float64
+	}{
+		{"twse_stock_price", 1234.56},
+		{"twse_stock_volume", 1234567},
+		{"twse_stock_turnover", 1234.56 * 1234567},
+	} {
+		if s, ok := find(samples, tt.name); !ok || s.value != tt.want {
+			t.Errorf("%s = %v, %v, want %v", tt.name, s.value, ok, tt.want)
+		}
+	}
+}
+
+func TestRoundHalfEven(t *testing.T) {
+	tests := []struct {
+		v        float64
+		decimals int
+		want     float64
+	}{
+		{1.005, 2, 1.00},
+		{1.015, 2, 1.02},
+		{1.025, 2, 1.02},
+		{2.675, 2, 2.68},
+		{1.0051, 2, 1.01},
+		{1.0049, 2, 1.00},
+		{-1.005, 2, -1.00},
+		{-1.015, 2, -1.02},
+		{593.5, 0, 594},
+		{594.5, 0, 594},
+		{1.005, -1, 1.005},
+	}
+	for _, tt := range tests {
+		if got := roundHalfEven(tt.v, tt.decimals); got != tt.want {
+			t.Errorf("roundHalfEven(%v, %d) = %v, want %v", tt.v, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestPriceDecimals(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PriceDecimals = 2
+	samples := gather(t, newTestCollector(opts, StockInfo{Ex: "tse", C: "2330", Ch: "2330.tw", Z: "10.005", Y: "10.015", V: "1.005"}))
+
+	for _, tt := range []struct {
+		name string
+		want float64
+	}{
+		{"twse_stock_price", 10.00},
+		{"twse_stock_prev_close", 10.02},
+		// Not a price
+		{"twse_stock_volume", 1.005},
+	} {
+		if s, ok := find(samples, tt.name); !ok || s.value != tt.want {
+			t.Errorf("%s = %v, %v, want %v", tt.name, s.value, ok, tt.want)
+		}
+	}
+}
+
+func TestEmitZeroValues(t *testing.T) {
+	// Early in the session, before the first trade of the day
+	info := StockInfo{Ex: "tse", C: "2330", Ch: "2330.tw", Z: "-", Y: "593.0000", O: "0", H: "-", V: "0", Tv: "0", G: "0_0_"}
+	for _, emit := range []bool{true, false} {
+		opts := DefaultOptions()
+		opts.EmitZeroValues = emit
+		samples := gather(t, newTestCollector(opts, info))
+
+		for _, name := range []string{"open", "volume", "tick_volume", "bid_volume"} {
+			s, ok := find(samples, "twse_stock_"+name)
+			if ok != emit || s.value != 0 {
+				t.Errorf("emitZeroValues %v: stock_%s = %v, %v, want sent %v", emit, name, s.value, ok, emit)
+			}
+		}
+		// Fields without a value are never sent
+		if _, ok := find(samples, "twse_stock_high"); ok {
+			t.Errorf("emitZeroValues %v: got stock_high of \"-\"", emit)
+		}
+		if s, ok := find(samples, "twse_stock_prev_close"); !ok || s.value != 593 {
+			t.Errorf("emitZeroValues %v: stock_prev_close = %v, %v, want 593", emit, s.value, ok)
+		}
+	}
+}
+
+func TestSampleTimestamps(t *testing.T) {
+	stocks := loadPayload(t)
+	for _, stamped := range []bool{true, false} {
+		opts := DefaultOptions()
+		opts.SampleTimestamps = stamped
+		samples := gather(t, newTestCollector(opts, stocks...))
+
+		want := int64(0)
+		if stamped {
+			// tlong of the payload, 2024-01-02 14:30:00 +08:00
+			want = 1704177000000
+		}
+		for _, name := range []string{"twse_stock_price", "twse_stock_bid_price", "twse_index_value"} {
+			if len(samples[name]) == 0 {
+				t.Errorf("no %s", name)
+			}
+			for _, s := range samples[name] {
+				if s.timestamp != want {
+					t.Errorf("sampleTimestamps %v: %s%v at %d, want %d", stamped, name, s.labels, s.timestamp, want)
+				}
+			}
+		}
+		// Exporter series are not stamped
+		if s, ok := find(samples, "twse_up"); !ok || s.timestamp != 0 {
+			t.Errorf("sampleTimestamps %v: twse_up at %d, want no timestamp", stamped, s.timestamp)
+		}
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	fetchedAt := time.Now().Add(-time.Second)
+	// A cache that is not refreshed between the scrapes
+	c := NewCollector("twse", nil, func(ctx context.Context) ([]CachedStock, time.Time, error) {
+		return nil, fetchedAt, nil
+	})
+
+	first, ok := find(gather(t, c), "twse_cache_age_seconds")
+	if !ok || first.value < 1 {
+		t.Fatalf("cache_age_seconds = %v, %v, want at least 1", first.value, ok)
+	}
+	time.Sleep(20 * time.Millisecond)
+	second, _ := find(gather(t, c), "twse_cache_age_seconds")
+	if second.value <= first.value {
+		t.Errorf("cache_age_seconds = %v then %v, want it to increase", first.value, second.value)
+	}
+	if s, _ := find(gather(t, c), "twse_last_update_timestamp_seconds"); s.value != float64(fetchedAt.UnixNano())/1e9 {
+		t.Errorf("last_update_timestamp_seconds = %v, want the fetch time", s.value)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	stocks := loadPayload(t)
+	for _, tt := range []struct {
+		maxSeries int
+		exceeded  float64
+	}{
+		{10, 1},
+		{10000, 0},
+	} {
+		opts := DefaultOptions()
+		opts.MaxSeries = tt.maxSeries
+		samples := gather(t, newTestCollector(opts, stocks...))
+
+		s, ok := find(samples, "twse_series_limit_exceeded")
+		if !ok || s.value != tt.exceeded {
+			t.Errorf("maxSeries %d: series_limit_exceeded = %v, %v, want %v", tt.maxSeries, s.value, ok, tt.exceeded)
+		}
+		var series int
+		for name, family := range samples {
+			if name != "twse_series_limit_exceeded" {
+				series += len(family)
+			}
+		}
+		if series > tt.maxSeries || (tt.exceeded == 1 && series != tt.maxSeries) {
+			t.Errorf("maxSeries %d: got %d series", tt.maxSeries, series)
+		}
+	}
+
+	// No limit, no series_limit_exceeded
+	if _, ok := find(gather(t, newTestCollector(nil, stocks...)), "twse_series_limit_exceeded"); ok {
+		t.Error("got series_limit_exceeded without maxSeries")
+	}
+}
+
+func TestPreOpen(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Baselines = map[string]float64{"tse_2330.tw": 580}
+	// Before the first trade of the day
+	info := StockInfo{Ex: "tse", C: "2330", Ch: "2330.tw", Pz: "-", Z: "-", Y: "593.0000", U: "652.0000", W: "534.0000", V: "0"}
+	samples := gather(t, newTestCollector(opts, info))
+
+	s, ok := find(samples, "twse_stock_price")
+	if !ok || s.value != 593 || s.labels["price_source"] != "y" {
+		t.Errorf("stock_price = %v%v, %v, want 593 from y", s.value, s.labels, ok)
+	}
+	if _, ok := find(samples, "twse_stock_baseline_price"); !ok {
+		t.Error("no stock_baseline_price")
+	}
+	// No trade to derive them from
+	for _, name := range []string{"change", "change_percent", "turnover", "deviation_percent", "at_limit"} {
+		if s, ok := find(samples, "twse_stock_"+name); ok {
+			t.Errorf("got stock_%s %v before the first trade", name, s.value)
+		}
+	}
+
+	// Once traded they are back
+	info.Z = "600.0000"
+	samples = gather(t, newTestCollector(opts, info))
+	if s, ok := find(samples, "twse_stock_change"); !ok || s.value != 7 {
+		t.Errorf("stock_change = %v, %v, want 7", s.value, ok)
+	}
+}
+
+func TestHaltedStock(t *testing.T) {
+	// A halted stock has state flags and no prices
+	info := StockInfo{Ex: "tse", C: "2330", Ch: "2330.tw", Ip: "3", Ts: "0", Pz: "-", Z: "-", Y: "-", O: "-", H: "-", L: "-", A: "-", B: "-", Tlong: "1704177000000"}
+	samples := gather(t, newTestCollector(nil, info))
+
+	s, ok := find(samples, "twse_stock_trading_state_info", "code", "2330")
+	if !ok || s.value != 1 || s.labels["ip"] != "3" || s.labels["ts"] != "0" {
+		t.Errorf("stock_trading_state_info = %v%v, %v, want 1 with ip 3, ts 0", s.value, s.labels, ok)
+	}
+	for _, name := range []string{"price", "open", "high", "low", "prev_close", "change", "bid_price", "ask_price", "at_limit"} {
+		if _, ok := find(samples, "twse_stock_"+name); ok {
+			t.Errorf("got stock_%s of a halted stock", name)
+		}
+	}
+	if s, ok := find(samples, "twse_stock_bid_levels"); !ok || s.value != 0 {
+		t.Errorf("stock_bid_levels = %v, %v, want 0", s.value, ok)
+	}
+
+	// Without flags there is no state series
+	info.Ip, info.Ts = "", ""
+	if _, ok := find(gather(t, newTestCollector(nil, info)), "twse_stock_trading_state_info"); ok {
+		t.Error("got stock_trading_state_info without ip and ts")
+	}
+}
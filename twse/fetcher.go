@@ -0,0 +1,519 @@
+package twse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultBaseURL        = "http://mis.twse.com.tw/stock"
+	DefaultTimeout        = 10 * time.Second
+	DefaultMaxRetries     = 3
+	DefaultChunkSize      = 50
+	DefaultMaxConcurrency = 4
+	// DefaultMaxResponseBytes is far above the few KB of a full chunk
+	DefaultMaxResponseBytes = 4 << 20
+	retryBaseDelay          = 200 * time.Millisecond
+	// bodySnippetSize is how much of an error response is kept
+	bodySnippetSize = 200
+	// rateLimitMaxWait is how long a request waits for Fetcher.Limiter
+	rateLimitMaxWait = time.Second
+	defaultUserAgent = "twse_exporter"
+)
+
+// Classes of fetch failures, matched with errors.Is
+var (
+	// ErrHTTP is a non-2xx response, see HTTPStatusError for the status
+	ErrHTTP = errors.New("unexpected HTTP status")
+	// ErrDecode is a response that is not the expected JSON
+	ErrDecode = errors.New("failed to decode response")
+	// ErrEmptyResponse is a response without any stock info
+	ErrEmptyResponse = errors.New("empty response")
+	// ErrResponseTooLarge is a response over Fetcher.MaxResponseBytes
+	ErrResponseTooLarge = errors.New("response too large")
+	// ErrUpstream is an error envelope from TWSE, see UpstreamError for
+	// the rtcode
+	ErrUpstream = errors.New("error response from TWSE")
+	// ErrRateLimited is a request skipped as Fetcher.Limiter would have
+	// delayed it too long
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// HTTPStatusError is returned for a non-2xx response from TWSE
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	// Body is the start of the response body, e.g. an HTML error page
+	Body string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected response %s: %s", e.Status, e.Body)
+}
+
+// Is makes an HTTPStatusError match ErrHTTP
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrHTTP
+}
+
+// UpstreamError is returned for a response whose rtcode is not 0000,
+// e.g. {"rtcode":"5001","rtmessage":"..."}. Like other errors it fails
+// over to the next upstream.
+type UpstreamError struct {
+	Rtcode    string
+	Rtmessage string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("rtcode %s: %s", e.Rtcode, e.Rtmessage)
+}
+
+// Is makes an UpstreamError match ErrUpstream
+func (e *UpstreamError) Is(target error) bool {
+	return target == ErrUpstream
+}
+
+// ErrorReasons are the values ErrorReason returns
+var ErrorReasons = []string{"http_status", "decode", "empty_response", "too_large", "upstream_error", "other"}
+
+// ErrorReason classifies a fetch error, e.g. for a reason label
+func ErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrHTTP):
+		return "http_status"
+	case errors.Is(err, ErrDecode):
+		return "decode"
+	case errors.Is(err, ErrEmptyResponse):
+		return "empty_response"
+	case errors.Is(err, ErrResponseTooLarge):
+		return "too_large"
+	case errors.Is(err, ErrUpstream):
+		return "upstream_error"
+	}
+	return "other"
+}
+
+// bodySnippet returns the start of body, safe to log
+func bodySnippet(body []byte) string {
+	if len(body) > bodySnippetSize {
+		body = body[:bodySnippetSize]
+	}
+	return strings.ToValidUTF8(strings.TrimSpace(string(body)), "")
+}
+
+// Fetcher queries the TWSE MIS API. Its fields must not be changed once
+// it is in use. Fields left zero, other than MaxRetries, fall back to the
+// defaults of NewFetcher.
+type Fetcher struct {
+	Client *http.Client
+	// BaseURLs of the MIS API, e.g. http://mis.twse.com.tw/stock, tried
+	// in order until one returns stock info
+	BaseURLs []string
+	// UserAgent is sent with every request to TWSE
+	UserAgent string
+	// MaxRetries is how many times a failed request is retried
+	MaxRetries int
+	// ChunkSize is the max number of symbols per request
+	ChunkSize int
+	// MaxConcurrency is the max number of chunks fetched at once
+	MaxConcurrency int
+	// PrimeSession enables fetching the index page for a session cookie
+	// before querying stock info. Client should have a cookie jar, one
+	// without is given a jar that only lasts for a FetchStockInfo call.
+	PrimeSession bool
+	// MaxResponseBytes caps the body read from TWSE, after decompression
+	MaxResponseBytes int64
+	// Limiter, when set, is waited on before every request to TWSE,
+	// including retries, other upstreams and session priming. A request
+	// it would delay over a second fails with ErrRateLimited.
+	Limiter *rate.Limiter
+	// SkipSymbolCounts leaves symbols_requested and symbols_received to
+	// other fetches, e.g. for one-off fetches of a few symbols
+	SkipSymbolCounts bool
+}
+
+// NewFetcher returns a Fetcher with default settings querying baseURLs
+func NewFetcher(client *http.Client, baseURLs ...string) *Fetcher {
+	f := &Fetcher{
+		Client:         client,
+		UserAgent:      defaultUserAgent,
+		MaxRetries:     DefaultMaxRetries,
+		ChunkSize:      DefaultChunkSize,
+		MaxConcurrency: DefaultMaxConcurrency,
+
+		MaxResponseBytes: DefaultMaxResponseBytes,
+	}
+	for _, baseURL := range baseURLs {
+		f.BaseURLs = append(f.BaseURLs, strings.TrimSuffix(baseURL, "/"))
+	}
+	return f
+}
+
+// withDefaults returns a copy of f with its zero fields set to the defaults
+func (f *Fetcher) withDefaults() *Fetcher {
+	d := *f
+	if d.Client == nil {
+		d.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	// Priming stores the session cookie in the jar
+	if d.PrimeSession && d.Client.Jar == nil {
+		client := *d.Client
+		// cookiejar.New never fails with nil options
+		client.Jar, _ = cookiejar.New(nil)
+		d.Client = &client
+	}
+	if len(d.BaseURLs) == 0 {
+		d.BaseURLs = []string{DefaultBaseURL}
+	}
+	// An empty User-Agent makes net/http send none
+	if d.UserAgent == "" {
+		d.UserAgent = defaultUserAgent
+	}
+	// A negative MaxRetries would not even make the first attempt
+	if d.MaxRetries < 0 {
+		d.MaxRetries = 0
+	}
+	if d.ChunkSize <= 0 {
+		d.ChunkSize = DefaultChunkSize
+	}
+	if d.MaxConcurrency <= 0 {
+		d.MaxConcurrency = DefaultMaxConcurrency
+	}
+	if d.MaxResponseBytes <= 0 {
+		d.MaxResponseBytes = DefaultMaxResponseBytes
+	}
+	return &d
+}
+
+// indexURL is the MIS page of baseURL that hands out the session cookie
+func indexURL(baseURL string) string {
+	return baseURL + "/index.jsp"
+}
+
+// FetchStockInfo queries the stock info of the symbols in exChList, e.g.
+// tse_2330.tw. When some chunks fail, the stocks of the others are
+// returned along with the error.
+func (f *Fetcher) FetchStockInfo(ctx context.Context, exChList []string) ([]StockInfo, error) {
+	f = f.withDefaults()
+
+	// TWSE drops symbols when too many are requested at once, so the
+	// list is queried in chunks.
+	var chunks [][]string
+	for start := 0; start < len(exChList); start += f.ChunkSize {
+		end := start + f.ChunkSize
+		if end > len(exChList) {
+			end = len(exChList)
+		}
+		chunks = append(chunks, exChList[start:end])
+	}
+
+	// Fetch with at most maxConcurrency workers, each result is stored at
+	// the index of its chunk so ordering is preserved.
+	results := make([][]StockInfo, len(chunks))
+	errs := make([]error, len(chunks))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < f.MaxConcurrency && w < len(chunks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = f.fetchChunk(ctx, chunks[i])
+			}
+		}()
+	}
+	for i := range chunks {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var stockInfos []StockInfo
+	var failed int
+	var firstErr error
+	seen := make(map[string]bool)
+	for i, infos := range results {
+		if errs[i] != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		// Duplicated symbols in exChList come back as duplicated rows;
+		// keep the first so each label set is only emitted once.
+		for _, info := range infos {
+			if seen[info.Key] {
+				slog.Warn("Skip duplicated stock", "symbol", info.Key)
+				continue
+			}
+			seen[info.Key] = true
+			stockInfos = append(stockInfos, info)
+		}
+	}
+
+	// TWSE silently drops unknown or suspended symbols
+	received := make(map[string]bool)
+	for _, info := range stockInfos {
+		received[Symbol(info)] = true
+	}
+	for i, chunk := range chunks {
+		if errs[i] != nil {
+			continue
+		}
+		for _, symbol := range chunk {
+			if !received[symbol] {
+				slog.Warn("Symbol missing from TWSE response", "symbol", symbol)
+			}
+		}
+	}
+	if !f.SkipSymbolCounts {
+		symbolsRequested.Set(float64(len(exChList)))
+		symbolsReceived.Set(float64(len(stockInfos)))
+	}
+
+	// Partial results are returned along with the error
+	if failed > 0 {
+		return stockInfos, fmt.Errorf("%d of %d chunks failed: %w", failed, len(chunks), firstErr)
+	}
+
+	return stockInfos, nil
+}
+
+// fetchChunk queries a single chunk of symbols from each upstream in
+// order, until one returns a non-empty msgArray
+func (f *Fetcher) fetchChunk(ctx context.Context, exChList []string) ([]StockInfo, error) {
+	var lastErr error
+	for _, baseURL := range f.BaseURLs {
+		stockInfos, err := f.fetchChunkFrom(ctx, baseURL, exChList)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// The other upstreams share the limiter
+		if errors.Is(err, ErrRateLimited) {
+			return nil, err
+		}
+		if err != nil {
+			if len(f.BaseURLs) > 1 {
+				slog.Warn("Fetch from upstream failed", "upstream", baseURL, "err", err)
+			}
+			lastErr = err
+			continue
+		}
+		upstreamSuccesses.WithLabelValues(baseURL).Inc()
+		return stockInfos, nil
+	}
+
+	return nil, lastErr
+}
+
+// fetchChunkFrom queries getStockInfo.jsp of baseURL for a single chunk
+// of symbols
+func (f *Fetcher) fetchChunkFrom(ctx context.Context, baseURL string, exChList []string) ([]StockInfo, error) {
+	// Establish a session cookie first, otherwise msgArray may be empty
+	if f.PrimeSession {
+		if err := f.primeSessionCookie(ctx, baseURL); err != nil {
+			return nil, err
+		}
+	}
+
+	// 將 string list 轉換為以 '|' 分隔的字串
+	exCh := strings.Join(exChList, "|")
+
+	// construct url
+	url := fmt.Sprintf("%s/api/getStockInfo.jsp?ex_ch=%s", baseURL, exCh)
+
+	// Send HTTP request
+	slog.Debug("Fetching stock info", "upstream", baseURL, "symbols", len(exChList))
+	start := time.Now()
+	body, err := f.fetchWithRetry(ctx, baseURL, url)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Fetched stock info", "upstream", baseURL, "symbols", len(exChList), "duration_ms", time.Since(start).Milliseconds())
+
+	// 解析 JSON 响应
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, ErrEmptyResponse
+	}
+	var response Response
+	// TWSE serves an HTML error page during maintenance, keep the start
+	// of the body to tell it from truncated JSON
+	if err := json.Unmarshal(body, &response); err != nil {
+		decodeErrors.Inc()
+		slog.Warn("Malformed response from TWSE", "upstream", baseURL, "body", bodySnippet(body), "err", err)
+		return nil, fmt.Errorf("%w: %v, body %q", ErrDecode, err, bodySnippet(body))
+	}
+	// Older responses may lack rtcode, only a code other than 0000 fails
+	if response.Rtcode != "" && response.Rtcode != rtcodeOK {
+		slog.Warn("Error response from TWSE", "upstream", baseURL, "rtcode", response.Rtcode, "rtmessage", response.Rtmessage)
+		return nil, &UpstreamError{Rtcode: response.Rtcode, Rtmessage: response.Rtmessage}
+	}
+	// TWSE answers 200 with an empty msgArray for unknown symbols or a
+	// missing session cookie
+	if len(response.MsgArray) == 0 {
+		emptyResponses.Inc()
+		slog.Warn("Empty msgArray from TWSE", "upstream", baseURL, "symbols", exCh)
+		return nil, fmt.Errorf("%w: empty msgArray", ErrEmptyResponse)
+	}
+
+	return response.MsgArray, nil
+}
+
+// primeSessionCookie fetches the MIS index page of baseURL so the cookie
+// jar of the client holds a session. It does nothing when a session exists.
+func (f *Fetcher) primeSessionCookie(ctx context.Context, baseURL string) error {
+	u, err := url.Parse(indexURL(baseURL))
+	if err != nil {
+		return err
+	}
+	if len(f.Client.Jar.Cookies(u)) > 0 {
+		return nil
+	}
+
+	if _, err := f.fetchWithRetry(ctx, baseURL, indexURL(baseURL)); err != nil {
+		return fmt.Errorf("failed to prime session: %w", err)
+	}
+	return nil
+}
+
+// fetchWithRetry GETs url of the upstream at baseURL, retrying network
+// errors and 5xx responses with exponential backoff. It gives up as soon
+// as ctx is done.
+func (f *Fetcher) fetchWithRetry(ctx context.Context, baseURL, url string) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= f.MaxRetries; attempt++ {
+		if attempt > 0 {
+			retriesTotal.Inc()
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if err := f.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("User-Agent", f.UserAgent)
+		req.Header.Set("Referer", indexURL(baseURL))
+
+		start := time.Now()
+		resp, err := f.Client.Do(req)
+		upstreamDuration.WithLabelValues(requestOutcome(resp, err), baseURL).Observe(time.Since(start).Seconds())
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			slog.Warn("Request to TWSE failed", "attempt", attempt+1, "err", err)
+			lastErr = fmt.Errorf("failed to fetch stock info: %v", err)
+			continue
+		}
+
+		// Read response
+		body, err := readBody(resp, f.MaxResponseBytes)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			statusErr := &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: bodySnippet(body)}
+			// Only server errors are worth retrying
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil, statusErr
+			}
+			slog.Warn("Request to TWSE failed", "attempt", attempt+1, "status", resp.StatusCode)
+			lastErr = statusErr
+			continue
+		}
+		// A misbehaving upstream is unlikely to shrink on retry
+		if errors.Is(err, ErrResponseTooLarge) {
+			return nil, err
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("failed to read response body: %v", err)
+			continue
+		}
+
+		return body, nil
+	}
+
+	return nil, lastErr
+}
+
+// wait waits on the Limiter for a request, for at most rateLimitMaxWait
+func (f *Fetcher) wait(ctx context.Context) error {
+	if f.Limiter == nil {
+		return nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, rateLimitMaxWait)
+	defer cancel()
+	if err := f.Limiter.Wait(waitCtx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// requestOutcome classifies the result of a request to TWSE for
+// upstream_request_duration_seconds
+func requestOutcome(resp *http.Response, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return "timeout"
+	case err != nil || resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "error"
+	}
+	return "success"
+}
+
+// readBody reads the body of resp, decompressing it when gzip encoded.
+// The transport only does so when it asked for gzip itself, while some
+// proxies compress anyway. A body over limit bytes is an error.
+func readBody(resp *http.Response, limit int64) ([]byte, error) {
+	var r io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress response: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w: over %d bytes", ErrResponseTooLarge, limit)
+	}
+	return body, nil
+}
+
+// backoff returns the delay before the given retry attempt, doubling
+// retryBaseDelay each time with up to 50% jitter.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << (attempt - 1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
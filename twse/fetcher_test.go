@@ -0,0 +1,575 @@
+package twse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// testSymbols are the symbols of testdata/getStockInfo.json, a response
+// captured from MIS
+var testSymbols = []string{"tse_2330.tw", "otc_6488.tw", "tse_t00.tw"}
+
+// serveFile returns a handler answering with the file at path
+func serveFile(t *testing.T, path string) http.HandlerFunc {
+	t.Helper()
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.Write(body)
+	}
+}
+
+// loadPayload returns the stocks of testdata/getStockInfo.json
+func loadPayload(t *testing.T) []StockInfo {
+	t.Helper()
+	body, err := os.ReadFile("testdata/getStockInfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response Response
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.MsgArray
+}
+
+// serveStocks returns a handler answering like getStockInfo.jsp with
+// those of stocks requested by ex_ch, counting the requests
+func serveStocks(stocks []StockInfo, requests *atomic.Int32) http.HandlerFunc {
+	bySymbol := make(map[string]StockInfo)
+	for _, info := range stocks {
+		bySymbol[Symbol(info)] = info
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			requests.Add(1)
+		}
+		response := Response{MsgArray: []StockInfo{}, Rtcode: "0000", Rtmessage: "OK"}
+		for _, symbol := range strings.Split(r.URL.Query().Get("ex_ch"), "|") {
+			if info, ok := bySymbol[symbol]; ok {
+				response.MsgArray = append(response.MsgArray, info)
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// newTestFetcher returns a Fetcher of a test server answering with
+// handler, without retry delays unless retries are set by the test
+func newTestFetcher(t *testing.T, handler http.Handler) *Fetcher {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	f := NewFetcher(server.Client(), server.URL)
+	f.MaxRetries = 0
+	return f
+}
+
+func TestFetchStockInfo(t *testing.T) {
+	var req *http.Request
+	payload := serveFile(t, "testdata/getStockInfo.json")
+	f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		payload(w, r)
+	}))
+
+	stockInfos, err := f.FetchStockInfo(context.Background(), testSymbols)
+	if err != nil {
+		t.Fatalf("FetchStockInfo() error = %v", err)
+	}
+
+	if req.URL.Path != "/api/getStockInfo.jsp" {
+		t.Errorf("path = %q, want /api/getStockInfo.jsp", req.URL.Path)
+	}
+	if got, want := req.URL.Query().Get("ex_ch"), "tse_2330.tw|otc_6488.tw|tse_t00.tw"; got != want {
+		t.Errorf("ex_ch = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("User-Agent"); got != "twse_exporter" {
+		t.Errorf("User-Agent = %q, want twse_exporter", got)
+	}
+	if got, want := req.Header.Get("Referer"), f.BaseURLs[0]+"/index.jsp"; got != want {
+		t.Errorf("Referer = %q, want %q", got, want)
+	}
+
+	if len(stockInfos) != len(testSymbols) {
+		t.Fatalf("got %d stocks, want %d", len(stockInfos), len(testSymbols))
+	}
+	for i, symbol := range testSymbols {
+		if got := Symbol(stockInfos[i]); got != symbol {
+			t.Errorf("stock %d is %s, want %s", i, got, symbol)
+		}
+	}
+	tsmc := stockInfos[0]
+	for _, field := range []struct{ name, got, want string }{
+		{"n", tsmc.N, "台積電"},
+		{"z", tsmc.Z, "593.0000"},
+		{"y", tsmc.Y, "593.0000"},
+		{"v", tsmc.V, "21917"},
+		{"tlong", tsmc.Tlong, "1704177000000"},
+		{"b", tsmc.B, "593.0000_592.0000_591.0000_590.0000_589.0000_"},
+		{"key", tsmc.Key, "tse_2330.tw_20240102"},
+	} {
+		if field.got != field.want {
+			t.Errorf("%s = %q, want %q", field.name, field.got, field.want)
+		}
+	}
+}
+
+func TestFetcherZeroValue(t *testing.T) {
+	payload := serveFile(t, "testdata/getStockInfo.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("User-Agent"); got != "twse_exporter" {
+			t.Errorf("User-Agent = %q, want twse_exporter", got)
+		}
+		payload(w, r)
+	}))
+	defer server.Close()
+
+	for _, f := range []*Fetcher{
+		{Client: server.Client(), BaseURLs: []string{server.URL}},
+		// No client, so no cookie jar to prime the session in
+		{BaseURLs: []string{server.URL}, PrimeSession: true},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stockInfos, err := f.FetchStockInfo(ctx, testSymbols)
+		if err != nil || len(stockInfos) != len(testSymbols) {
+			t.Errorf("PrimeSession %v: FetchStockInfo() = %d stocks, %v, want %d stocks", f.PrimeSession, len(stockInfos), err, len(testSymbols))
+		}
+	}
+}
+
+func TestFetcherLimiter(t *testing.T) {
+	var requests atomic.Int32
+	f := newTestFetcher(t, serveStocks(loadPayload(t), &requests))
+	f.ChunkSize = 1
+	f.MaxConcurrency = 1
+	f.Limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+
+	// Every chunk is a request, only the first fits the burst
+	stockInfos, err := f.FetchStockInfo(context.Background(), testSymbols)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("FetchStockInfo() error = %v, want ErrRateLimited", err)
+	}
+	if len(stockInfos) != 1 || Symbol(stockInfos[0]) != testSymbols[0] {
+		t.Errorf("FetchStockInfo() = %v, want the first chunk only", stockInfos)
+	}
+
+	stockInfos, err = f.FetchStockInfo(context.Background(), testSymbols[:1])
+	if !errors.Is(err, ErrRateLimited) || len(stockInfos) != 0 {
+		t.Errorf("FetchStockInfo() = %d stocks, %v, want ErrRateLimited", len(stockInfos), err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestFetcherLimiterRetries(t *testing.T) {
+	var requests atomic.Int32
+	f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	f.MaxRetries = 3
+	f.Limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+
+	// Retries wait on the limiter too
+	if _, err := f.FetchStockInfo(context.Background(), testSymbols); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("FetchStockInfo() error = %v, want ErrRateLimited", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestFetchStockInfoClientError(t *testing.T) {
+	var requests atomic.Int32
+	client := &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		requests.Add(1)
+		return nil, errors.New("connection reset by peer")
+	})}
+	f := NewFetcher(client, DefaultBaseURL)
+	f.MaxRetries = 1
+
+	// The error is returned rather than ending the process
+	stockInfos, err := f.FetchStockInfo(context.Background(), testSymbols)
+	if err == nil || !strings.Contains(err.Error(), "connection reset by peer") {
+		t.Errorf("FetchStockInfo() error = %v, want the client error", err)
+	}
+	if len(stockInfos) != 0 {
+		t.Errorf("FetchStockInfo() = %d stocks, want none", len(stockInfos))
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("sent %d requests, want 2 with a retry", n)
+	}
+}
+
+func TestFetchStockInfoTimeout(t *testing.T) {
+	f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	f.Client.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := f.FetchStockInfo(context.Background(), testSymbols)
+	if err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded") {
+		t.Errorf("FetchStockInfo() error = %v, want a client timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("FetchStockInfo() took %v, want the 50ms timeout", elapsed)
+	}
+}
+
+// syntheticStocks returns n stocks with codes from 1000 on
+func syntheticStocks(n int) ([]StockInfo, []string) {
+	var stocks []StockInfo
+	var symbols []string
+	for i := 0; i < n; i++ {
+		code := strconv.Itoa(1000 + i)
+		info := StockInfo{Ex: "tse", C: code, Ch: code + ".tw", Key: "tse_" + code + ".tw_20240102", Z: "10.0000"}
+		stocks = append(stocks, info)
+		symbols = append(symbols, Symbol(info))
+	}
+	return stocks, symbols
+}
+
+func TestFetchStockInfoChunks(t *testing.T) {
+	stocks, symbols := syntheticStocks(120)
+	var requests atomic.Int32
+	f := newTestFetcher(t, serveStocks(stocks, &requests))
+
+	// A duplicated symbol is requested twice but returned once
+	stockInfos, err := f.FetchStockInfo(context.Background(), append(symbols, symbols[0]))
+	if err != nil {
+		t.Fatalf("FetchStockInfo() error = %v", err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("sent %d requests, want 3 chunks of at most %d", n, DefaultChunkSize)
+	}
+	if len(stockInfos) != len(symbols) {
+		t.Fatalf("got %d stocks, want %d", len(stockInfos), len(symbols))
+	}
+	for i, symbol := range symbols {
+		if got := Symbol(stockInfos[i]); got != symbol {
+			t.Errorf("stock %d is %s, want %s", i, got, symbol)
+		}
+	}
+}
+
+// TestFetchStockInfoConcurrent is meant for go test -race
+func TestFetchStockInfoConcurrent(t *testing.T) {
+	stocks, symbols := syntheticStocks(200)
+	serve := serveStocks(stocks, nil)
+	f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail every other chunk of 10, by the code of its first symbol
+		first, _, _ := strings.Cut(r.URL.Query().Get("ex_ch"), "|")
+		_, code := SplitSymbol(first)
+		if n, _ := strconv.Atoi(code); (n-1000)/10%2 == 1 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		serve(w, r)
+	}))
+	f.ChunkSize = 10
+	f.MaxConcurrency = 8
+
+	stockInfos, err := f.FetchStockInfo(context.Background(), symbols)
+	if !errors.Is(err, ErrHTTP) || !strings.HasPrefix(err.Error(), "10 of 20 chunks failed") {
+		t.Errorf("FetchStockInfo() error = %v, want 10 of 20 chunks failed", err)
+	}
+	var want []string
+	for i, symbol := range symbols {
+		if i/10%2 == 0 {
+			want = append(want, symbol)
+		}
+	}
+	if len(stockInfos) != len(want) {
+		t.Fatalf("got %d stocks, want %d", len(stockInfos), len(want))
+	}
+	for i, symbol := range want {
+		if got := Symbol(stockInfos[i]); got != symbol {
+			t.Errorf("stock %d is %s, want %s", i, got, symbol)
+		}
+	}
+}
+
+// counterValue returns the value of c, which is global to the tests
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	for _, samples := range gather(t, c) {
+		return samples[0].value
+	}
+	return 0
+}
+
+func TestFetchStockInfoErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr error
+		// wantMsg is a part of the error message
+		wantMsg string
+		// counter also increases by one, nil for none
+		counter prometheus.Counter
+	}{
+		{
+			name: "503",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("<html><body>系統維護中</body></html>"))
+			},
+			wantErr: ErrHTTP,
+			wantMsg: "503 Service Unavailable: <html><body>系統維護中</body></html>",
+		},
+		{
+			name: "empty msgArray",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"msgArray":[],"referer":"","userDelay":5000,"rtcode":"0000","rtmessage":"OK"}`))
+			},
+			wantErr: ErrEmptyResponse,
+			wantMsg: "empty msgArray",
+			counter: emptyResponses,
+		},
+		{
+			name: "truncated JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"msgArray":[{"c":"2330","n":"台積電","z":"593.0`))
+			},
+			wantErr: ErrDecode,
+			wantMsg: `body "{\"msgArray\":[{\"c\":\"2330\"`,
+			counter: decodeErrors,
+		},
+		{
+			name: "HTML page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte("<!DOCTYPE html><html><head><title>系統維護</title></head></html>"))
+			},
+			wantErr: ErrDecode,
+			wantMsg: "<title>系統維護</title>",
+			counter: decodeErrors,
+		},
+		{
+			name:    "rtcode",
+			handler: serveFile(t, "testdata/getStockInfo_error.json"),
+			wantErr: ErrUpstream,
+			wantMsg: "rtcode 5001: Empty Query.",
+		},
+		{
+			name:    "empty body",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			wantErr: ErrEmptyResponse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFetcher(t, tt.handler)
+			var count float64
+			if tt.counter != nil {
+				count = counterValue(t, tt.counter)
+			}
+			stockInfos, err := f.FetchStockInfo(context.Background(), testSymbols)
+			if !errors.Is(err, tt.wantErr) || !strings.Contains(fmt.Sprint(err), tt.wantMsg) {
+				t.Errorf("FetchStockInfo() error = %v, want %v with %q", err, tt.wantErr, tt.wantMsg)
+			}
+			if len(stockInfos) != 0 {
+				t.Errorf("FetchStockInfo() = %d stocks, want none", len(stockInfos))
+			}
+			if tt.counter != nil {
+				if got := counterValue(t, tt.counter) - count; got != 1 {
+					t.Errorf("counter increased by %v, want 1", got)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchStockInfoGzip(t *testing.T) {
+	body, err := os.ReadFile("testdata/getStockInfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+	// Like a proxy compressing whether asked or not
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	})
+
+	for _, disableCompression := range []bool{false, true} {
+		f := newTestFetcher(t, handler)
+		f.Client.Transport.(*http.Transport).DisableCompression = disableCompression
+		stockInfos, err := f.FetchStockInfo(context.Background(), testSymbols)
+		if err != nil || len(stockInfos) != len(testSymbols) {
+			t.Errorf("DisableCompression %v: FetchStockInfo() = %d stocks, %v, want %d stocks", disableCompression, len(stockInfos), err, len(testSymbols))
+		}
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		err     error
+		wantErr error
+		want    string
+	}{
+		{&HTTPStatusError{StatusCode: 503, Status: "503 Service Unavailable"}, ErrHTTP, "http_status"},
+		{fmt.Errorf("%w: unexpected EOF", ErrDecode), ErrDecode, "decode"},
+		{ErrEmptyResponse, ErrEmptyResponse, "empty_response"},
+		{fmt.Errorf("%w: over 10 bytes", ErrResponseTooLarge), ErrResponseTooLarge, "too_large"},
+		{&UpstreamError{Rtcode: "5001"}, ErrUpstream, "upstream_error"},
+		{errors.New("connection refused"), nil, "other"},
+	}
+	for _, tt := range tests {
+		// As returned by FetchStockInfo
+		err := fmt.Errorf("1 of 1 chunks failed: %w", tt.err)
+		if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("errors.Is(%v, %v) = false, want true", err, tt.wantErr)
+		}
+		if got := ErrorReason(err); got != tt.want {
+			t.Errorf("ErrorReason(%v) = %q, want %q", err, got, tt.want)
+		}
+		if !slices.Contains(ErrorReasons, tt.want) {
+			t.Errorf("%q is not in ErrorReasons", tt.want)
+		}
+	}
+}
+
+func TestFetchStockInfoErrorTypes(t *testing.T) {
+	f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	_, err := f.FetchStockInfo(context.Background(), testSymbols)
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("FetchStockInfo() error = %v, want an HTTPStatusError", err)
+	}
+	if statusErr.StatusCode != http.StatusForbidden || statusErr.Body != "forbidden" {
+		t.Errorf("HTTPStatusError = %+v, want 403 with the body", statusErr)
+	}
+	if errors.Is(err, ErrDecode) || errors.Is(err, ErrUpstream) {
+		t.Errorf("FetchStockInfo() error = %v matches another class", err)
+	}
+}
+
+func TestFetchStockInfoDecodeLog(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>Service Unavailable</html>"))
+	}))
+	if _, err := f.FetchStockInfo(context.Background(), testSymbols); !errors.Is(err, ErrDecode) {
+		t.Errorf("FetchStockInfo() error = %v, want ErrDecode", err)
+	}
+	// The log tells an HTML page from truncated JSON
+	if want := `msg="Malformed response from TWSE"`; !strings.Contains(logs.String(), want) ||
+		!strings.Contains(logs.String(), `body="<html>Service Unavailable</html>"`) {
+		t.Errorf("no %s with the body in:\n%s", want, logs.String())
+	}
+}
+
+func TestFetchStockInfoTooLarge(t *testing.T) {
+	body, err := os.ReadFile("testdata/getStockInfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"plain", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		}},
+		// The limit applies after decompression
+		{"gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				tt.handler(w, r)
+			}))
+			f.Client.Transport.(*http.Transport).DisableCompression = true
+			f.MaxResponseBytes = int64(len(body)) - 1
+			f.MaxRetries = 1
+
+			_, err := f.FetchStockInfo(context.Background(), testSymbols)
+			if !errors.Is(err, ErrResponseTooLarge) || !strings.Contains(err.Error(), fmt.Sprintf("over %d bytes", f.MaxResponseBytes)) {
+				t.Errorf("FetchStockInfo() error = %v, want ErrResponseTooLarge", err)
+			}
+			// Not retried
+			if n := requests.Load(); n != 1 {
+				t.Errorf("sent %d requests, want 1", n)
+			}
+
+			f.MaxResponseBytes = int64(len(body))
+			if stockInfos, err := f.FetchStockInfo(context.Background(), testSymbols); err != nil || len(stockInfos) != len(testSymbols) {
+				t.Errorf("FetchStockInfo() at the limit = %d stocks, %v, want %d stocks", len(stockInfos), err, len(testSymbols))
+			}
+		})
+	}
+}
+
+func TestFetchStockInfoUpstreamError(t *testing.T) {
+	var requests atomic.Int32
+	payload := serveFile(t, "testdata/getStockInfo_error.json")
+	f := newTestFetcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		payload(w, r)
+	}))
+	f.MaxRetries = 2
+
+	_, err := f.FetchStockInfo(context.Background(), testSymbols)
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.Rtcode != "5001" || upstreamErr.Rtmessage != "Empty Query." {
+		t.Errorf("FetchStockInfo() error = %v, want an UpstreamError of rtcode 5001", err)
+	}
+	// The envelope comes with a 200, which is not retried
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
@@ -0,0 +1,57 @@
+package twse
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics of the fetches themselves, see RegisterMetrics
+var (
+	retriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fetch_retries_total",
+		Help: "Total number of retried requests to TWSE",
+	})
+	parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "parse_errors_total",
+		Help: "Total number of stock fields that failed to parse, which are skipped",
+	}, []string{"symbol"})
+	upstreamSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_successes_total",
+		Help: "Total number of chunks fetched successfully, by upstream base URL",
+	}, []string{"upstream"})
+	decodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "decode_errors_total",
+		Help: "Total number of responses from TWSE that are not valid JSON",
+	})
+	emptyResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "empty_responses_total",
+		Help: "Total number of responses from TWSE with an empty msgArray",
+	})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_request_duration_seconds",
+		Help:    "Duration of requests to TWSE until the response headers, by outcome success, error or timeout and upstream base URL",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 16},
+	}, []string{"outcome", "upstream"})
+	symbolsRequested = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "symbols_requested",
+		Help: "Number of symbols requested from TWSE in the last fetch",
+	})
+	symbolsReceived = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "symbols_received",
+		Help: "Number of stocks received from TWSE in the last fetch",
+	})
+)
+
+// RegisterMetrics registers the metrics of Fetcher and Collector, such as
+// fetch_retries_total, with r. Their names carry no prefix, wrap r with
+// prometheus.WrapRegistererWithPrefix for one. They are updated whether
+// registered or not, and may be registered once.
+func RegisterMetrics(r prometheus.Registerer) {
+	r.MustRegister(
+		retriesTotal,
+		symbolsRequested,
+		symbolsReceived,
+		parseErrors,
+		upstreamSuccesses,
+		upstreamDuration,
+		decodeErrors,
+		emptyResponses,
+	)
+}
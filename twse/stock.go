@@ -0,0 +1,91 @@
+// Package twse fetches quotes from the TWSE MIS API, the API behind
+// https://mis.twse.com.tw, and exports them as Prometheus metrics.
+package twse
+
+import "strings"
+
+// StockInfo is a row of msgArray returned by getStockInfo.jsp. TWSE
+// does not document the fields, those without a comment are unknown.
+type StockInfo struct {
+	At      string `json:"@"`
+	Tv      string `json:"tv"` // 當盤成交量
+	Ps      string `json:"ps"` // 試算參考成交量
+	Nu      string `json:"nu"`
+	Pid     string `json:"pid"`
+	Pz      string `json:"pz"` // 試算參考成交價
+	Bp      string `json:"bp"`
+	Fv      string `json:"fv"`
+	Oa      string `json:"oa"`
+	Ob      string `json:"ob"`
+	M       string `json:"m%"`
+	Key     string `json:"key"` // <ex>_<ch>_<date>, e.g. tse_2330.tw_20240102
+	Caret   string `json:"^"`
+	A       string `json:"a"` // 最佳五檔賣出價, "_" separated
+	B       string `json:"b"` // 最佳五檔買進價, "_" separated
+	C       string `json:"c"` // 股票代號
+	Hash    string `json:"#"`
+	D       string `json:"d"` // 交易日期 YYYYMMDD
+	Percent string `json:"%"`
+	Ch      string `json:"ch"`    // <code>.tw
+	Tlong   string `json:"tlong"` // 報價時間, epoch milliseconds
+	Ot      string `json:"ot"`
+	F       string `json:"f"`  // 最佳五檔賣出量, "_" separated
+	G       string `json:"g"`  // 最佳五檔買進量, "_" separated
+	Ip      string `json:"ip"` // 狀態旗標, e.g. trend or halt, see stock_trading_state_info
+	Mt      string `json:"mt"`
+	Ov      string `json:"ov"`
+	H       string `json:"h"` // 最高價
+	It      string `json:"it"`
+	Oz      string `json:"oz"`
+	L       string `json:"l"`  // 最低價
+	N       string `json:"n"`  // 公司簡稱
+	O       string `json:"o"`  // 開盤價, the first trade of the session
+	P       string `json:"p"`  // 參考價, the base of the price limits, 0 when not sent
+	Ex      string `json:"ex"` // tse (上市) or otc (上櫃), other exchanges see quote_value
+	S       string `json:"s"`
+	T       string `json:"t"`  // 報價時間 HH:MM:SS
+	U       string `json:"u"`  // 漲停價
+	V       string `json:"v"`  // 累積成交量 (張)
+	W       string `json:"w"`  // 跌停價
+	Nf      string `json:"nf"` // 公司全名
+	Y       string `json:"y"`  // 昨收價
+	Z       string `json:"z"`  // 最近成交價
+	Ts      string `json:"ts"` // 試撮旗標, see stock_trading_state_info
+}
+
+// Response is the body of getStockInfo.jsp
+type Response struct {
+	MsgArray []StockInfo `json:"msgArray"`
+	// Rtcode is 0000 on success, other codes come with Rtmessage and no
+	// msgArray, see UpstreamError
+	Rtcode    string `json:"rtcode"`
+	Rtmessage string `json:"rtmessage"`
+}
+
+// rtcodeOK is the rtcode of a successful response
+const rtcodeOK = "0000"
+
+// Symbol identifies a stock as <ex>_<ch>, e.g. tse_2330.tw. Unlike the
+// key field it carries no trading date, so it is stable across days.
+func Symbol(info StockInfo) string {
+	return info.Ex + "_" + info.Ch
+}
+
+// SplitCh splits the ch field of info, e.g. 2330.tw, into the code and
+// the market suffix such as tw. A ch without both falls back to the c
+// field and no suffix.
+func SplitCh(info StockInfo) (string, string) {
+	i := strings.LastIndex(info.Ch, ".")
+	if i <= 0 || i == len(info.Ch)-1 {
+		return info.C, ""
+	}
+	return info.Ch[:i], info.Ch[i+1:]
+}
+
+// SplitSymbol splits an exChList entry such as tse_2330.tw into its
+// exchange and code
+func SplitSymbol(symbol string) (string, string) {
+	ex, ch, _ := strings.Cut(symbol, "_")
+	code, _, _ := strings.Cut(ch, ".")
+	return ex, code
+}